@@ -0,0 +1,164 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/deadletter"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/queue"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+// replay outcomes
+const (
+	REPLAY_SENT       = "sent"
+	REPLAY_FAILED     = "failed"
+	REPLAY_LOCKED     = "locked"
+	REPLAY_LIMITED    = "limited"
+	REPLAY_SUPERSEDED = "superseded"
+)
+
+var deadLetters *deadletter.Store
+
+// replayingKey marks the context of a replay, whose failure is kept in the replayed entry
+type replayingKey struct{}
+
+// failedSend is an error of the provider, as opposed to the cache, only those are dead-lettered
+type failedSend struct {
+	error
+}
+
+func (e failedSend) Unwrap() error {
+	return e.error
+}
+
+// SetDeadLetters makes failed sends recorded in s, nil does not record them
+func SetDeadLetters(s *deadletter.Store) {
+	deadLetters = s
+}
+
+// recordFailedSend adds a code the provider did not accept to the dead-letter store. It is called once
+// the code can not reach the user any more, not for sends that are retried or fall back to another
+// channel. Sends canceled by the client are not recorded, the provider may well have been fine
+func recordFailedSend(ctx context.Context, destination string, channel string, language string, sendErr error) {
+	var failed failedSend
+	if deadLetters == nil || !errors.As(sendErr, &failed) || errors.Is(sendErr, context.Canceled) || ctx.Value(replayingKey{}) != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second*5)
+	defer cancel()
+
+	id, err := deadLetters.Add(ctx, deadletter.Entry{
+		Destination: destination,
+		Channel:     channel,
+		Language:    language,
+		Error:       sendErr.Error(),
+		ErrorCode:   sender.ErrorCode(sendErr),
+		Attempts:    max(1, sender.Attempts(sendErr)),
+		FailedAt:    time.Now().UTC(),
+	})
+	if err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to record failed send : %s", err.Error()))
+		return
+	}
+	utils.Log.Debug(fmt.Sprintf("Recorded failed send as dead letter %s", id))
+}
+
+// recordDeadJob adds a send job the workers gave up on to the dead-letter store
+func recordDeadJob(ctx context.Context, message queue.Message, reason error) error {
+	if deadLetters == nil {
+		return errors.New("no dead-letter store")
+	}
+	entry := deadletter.Entry{
+		Error:      reason.Error(),
+		ErrorCode:  sender.ErrorCode(reason),
+		Attempts:   sender.Attempts(reason),
+		JobID:      message.ID,
+		Deliveries: message.Deliveries,
+		FailedAt:   time.Now().UTC(),
+	}
+	if message.Job != nil {
+		entry.Destination = message.Job.Destination
+		entry.Channel = message.Job.Channel
+		entry.Language = message.Job.Language
+	}
+	_, err := deadLetters.Add(ctx, entry)
+	return err
+}
+
+// markSent remembers when a code last reached the provider for the identifier, as long as dead
+// letters are kept, so a replay does not send a code the user no longer waits for
+func markSent(ctx context.Context, identifier string) error {
+	if deadLetters == nil {
+		return nil
+	}
+	return storeInCache(ctx, utils.GetLastSentKey(identifier), time.Now().UnixMilli(), deadLetters.Retention())
+}
+
+// lastSent returns when a code last reached the provider for the identifier, the zero time when none did
+// within the dead-letter retention
+func lastSent(ctx context.Context, identifier string) (time.Time, error) {
+	value, err := getCachedData(ctx, utils.GetLastSentKey(identifier))
+	if err != nil || value == nil {
+		return time.Time{}, err
+	}
+	millis, err := strconv.ParseInt(fmt.Sprint(value), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(millis), nil
+}
+
+// ReplayDeadLetter issues a new code to the destination of entry through the sender and removes the
+// entry once the provider accepted it. Locked destinations and destinations out of codes or sends are
+// skipped, and an entry whose destination got a code after it failed is removed without sending.
+// A failed replay keeps the entry
+func ReplayDeadLetter(ctx context.Context, entry deadletter.Entry) (string, error) {
+	if entry.Destination == "" {
+		return "", fmt.Errorf("dead letter %s has no destination to replay", entry.ID)
+	}
+	data := OTPData{Channel: entry.Channel, Language: entry.Language}
+	if entry.Channel == sender.EMAIL {
+		data.Email = entry.Destination
+	} else {
+		data.PhoneNumber = entry.Destination
+	}
+	identifier := data.Identifier()
+
+	lock, err := GetOTPLock(ctx, identifier)
+	if err != nil {
+		return "", err
+	}
+	if lock != nil {
+		return REPLAY_LOCKED, nil
+	}
+	sent, err := lastSent(ctx, identifier)
+	if err != nil {
+		return "", err
+	}
+	if sent.After(entry.FailedAt) {
+		_, err := deadLetters.Delete(ctx, entry.ID)
+		return REPLAY_SUPERSEDED, err
+	}
+
+	//a replay is a new code like any other and counts against the limits of the destination
+	_, taken, err := TakeIssueLimits(ctx, identifier)
+	if err != nil {
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			return REPLAY_LIMITED, nil
+		}
+		return "", err
+	}
+	if _, _, err := IssueOTP(context.WithValue(ctx, replayingKey{}, true), data); err != nil {
+		taken.refund(ctx)
+		utils.Log.Info(fmt.Sprintf("Replay of dead letter %s failed : %s", entry.ID, err.Error()))
+		return REPLAY_FAILED, err
+	}
+	_, err = deadLetters.Delete(ctx, entry.ID)
+	return REPLAY_SENT, err
+}
@@ -0,0 +1,430 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/queue"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+// STATUS_CALLBACK_PATH is where twilio reports message delivery status changes
+const STATUS_CALLBACK_PATH = "/api/twilio/message-status"
+
+// what caused a delivery attempt
+const (
+	TRIGGER_REQUEST         = "request"
+	TRIGGER_STATUS_CALLBACK = "status_callback"
+	TRIGGER_TIMEOUT         = "timeout"
+	TRIGGER_RESEND          = "resend"
+)
+
+// message statuses twilio reports once a message will not reach the phone
+var notDelivered = map[string]bool{
+	"failed":      true,
+	"undelivered": true,
+}
+
+// statusRank orders message statuses, callbacks can arrive out of order and must not move a message back
+var statusRank = map[string]int{
+	"accepted":    1,
+	"queued":      2,
+	"sending":     3,
+	"sent":        4,
+	"failed":      5,
+	"undelivered": 5,
+	"delivered":   5,
+	"read":        6,
+}
+
+// fallbackConfig is the opt-in policy of re-sending the code on the next channel
+type fallbackConfig struct {
+	enabled  bool
+	channels []string
+	after    time.Duration
+}
+
+func getFallbackConfig() (fallbackConfig, error) {
+	var cfg fallbackConfig
+	var err error
+	if cfg.enabled, err = utils.GetBoolFromConf("otp-fallback-enabled", false); err != nil {
+		return cfg, err
+	}
+	channels, err := utils.GetStringFromConf("otp-fallback-channels", "sms,whatsapp,voice")
+	if err != nil {
+		return cfg, err
+	}
+	for _, channel := range strings.Split(channels, ",") {
+		if channel = strings.TrimSpace(channel); channel != "" {
+			cfg.channels = append(cfg.channels, channel)
+		}
+	}
+	if cfg.after, err = utils.GetSecondsFromConf("otp-fallback-after", 0); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func newVerificationID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusCallbackURL returns the url twilio reports the status of the next attempt of delivery to, empty
+// when the channel has no message status or the service is not reachable from twilio. The url carries
+// an opaque ref of the delivery instead of the identifier
+func statusCallbackURL(ctx context.Context, identifier string, delivery *Delivery, channel string) (string, error) {
+	if verifyService != nil || (channel != sender.SMS && channel != sender.WHATSAPP) {
+		return "", nil
+	}
+	baseURL, err := utils.GetStringFromConf("public-base-url", "")
+	if err != nil || baseURL == "" {
+		return "", err
+	}
+	if delivery.CallbackRef == "" {
+		delivery.CallbackRef = newVerificationID()
+		if err := saveStatusCallbackRef(ctx, identifier, delivery); err != nil {
+			return "", err
+		}
+	}
+	query := url.Values{}
+	query.Set("ref", delivery.CallbackRef)
+	query.Set("attempt", strconv.Itoa(len(delivery.Attempts)))
+	return fmt.Sprintf("%s%s?%s", strings.TrimSuffix(baseURL, "/"), STATUS_CALLBACK_PATH, query.Encode()), nil
+}
+
+// saveStatusCallbackRef stores what the callback ref of delivery stands for, as long as the code
+func saveStatusCallbackRef(ctx context.Context, identifier string, delivery *Delivery) error {
+	expiry, err := deliveryExpiry(ctx, identifier)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(StatusCallbackRef{Identifier: identifier, VerificationID: delivery.VerificationID})
+	if err != nil {
+		return err
+	}
+	if err := storeInCache(ctx, utils.GetStatusCallbackKey(delivery.CallbackRef), string(value), expiry); err != nil {
+		utils.Log.Debug("Error : Failed to store status callback ref in cache")
+		return err
+	}
+	return nil
+}
+
+// GetStatusCallbackRef returns the identifier and verification a status callback ref stands for, nil
+// when it is unknown or expired
+func GetStatusCallbackRef(ctx context.Context, ref string) (*StatusCallbackRef, error) {
+	cached, err := getCachedData(ctx, utils.GetStatusCallbackKey(ref))
+	if err != nil || cached == nil {
+		return nil, err
+	}
+	var callbackRef StatusCallbackRef
+	if err := json.Unmarshal([]byte(cached.(string)), &callbackRef); err != nil {
+		return nil, err
+	}
+	return &callbackRef, nil
+}
+
+// channelSupported reports whether the configured senders can deliver on channel
+func channelSupported(channel string) bool {
+	if verifyService != nil {
+		return channel != sender.EMAIL
+	}
+	if channels, ok := otpSender.(sender.Channels); ok {
+		return channels.Supports(channel)
+	}
+	return true
+}
+
+// nextChannel returns the first channel after the last one tried that was not tried yet, empty when none is left
+func nextChannel(order []string, delivery *Delivery) string {
+	tried := make(map[string]bool)
+	for _, channel := range delivery.Channels() {
+		tried[channel] = true
+	}
+	last := delivery.Attempts[len(delivery.Attempts)-1].Channel
+	start := 0
+	for i, channel := range order {
+		if channel == last {
+			start = i + 1
+			break
+		}
+	}
+	for _, channel := range order[start:] {
+		if !tried[channel] && channel != sender.EMAIL && channelSupported(channel) {
+			return channel
+		}
+	}
+	return ""
+}
+
+// GetDelivery returns the delivery attempts of the current code of the identifier, nil when there is none
+func GetDelivery(ctx context.Context, identifier string) (*Delivery, error) {
+	cached, err := getCachedData(ctx, utils.GetDeliveryKey(identifier))
+	if err != nil {
+		utils.Log.Debug("Error : Failed to fetch delivery from cache")
+		return nil, err
+	}
+	if cached == nil {
+		utils.Log.Debug("Delivery not present in cache")
+		return nil, nil
+	}
+	var delivery Delivery
+	if err := json.Unmarshal([]byte(cached.(string)), &delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// deliveryExpiry returns how long delivery state is kept, as long as the code or a full OTP timeout once it is gone
+func deliveryExpiry(ctx context.Context, identifier string) (time.Duration, error) {
+	expiry, err := getTTLData(ctx, utils.GetOTPCodeKey(identifier))
+	if err != nil {
+		return 0, err
+	}
+	if expiry <= 0 {
+		if expiry, err = utils.GetOTPTimeout(); err != nil {
+			utils.Log.Debug("Error : Failed to fetch OTP timeout from conf")
+			return 0, err
+		}
+	}
+	return expiry, nil
+}
+
+// saveDelivery stores the delivery until the code expires
+func saveDelivery(ctx context.Context, identifier string, delivery *Delivery) error {
+	expiry, err := deliveryExpiry(ctx, identifier)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	if err := storeInCache(ctx, utils.GetDeliveryKey(identifier), string(value), expiry); err != nil {
+		utils.Log.Debug("Error : Failed to store delivery in cache")
+		return err
+	}
+	utils.Log.Debug("Successfully stored delivery in cache")
+	return nil
+}
+
+// recordAttempt appends one delivery attempt and, for phone numbers with fallback enabled, schedules the
+// timeout fallback on the send queue. Without the queue only status callbacks fall back
+func recordAttempt(ctx context.Context, identifier string, delivery *Delivery, channel string, trigger string, res sender.Result) error {
+	delivery.Attempts = append(delivery.Attempts, DeliveryAttempt{
+		Channel:   channel,
+		Trigger:   trigger,
+		Provider:  res.Provider,
+		MessageID: res.MessageID,
+		Status:    res.Status,
+		SentAt:    time.Now().UTC(),
+	})
+	if err := saveDelivery(ctx, identifier, delivery); err != nil {
+		return err
+	}
+	if res.Status != "failed" {
+		if err := markSent(ctx, identifier); err != nil {
+			utils.Log.Warn(fmt.Sprintf("Failed to mark code as sent : %s", err.Error()))
+		}
+	}
+
+	cfg, err := getFallbackConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.enabled && cfg.after > 0 && channel != sender.EMAIL && sendQueue != nil {
+		now := time.Now().UTC()
+		job := queue.Job{
+			VerificationID: delivery.VerificationID,
+			Identifier:     identifier,
+			Trigger:        TRIGGER_TIMEOUT,
+			Attempt:        len(delivery.Attempts) - 1,
+			EnqueuedAt:     now,
+		}
+		if err := sendQueue.Schedule(ctx, job, now.Add(cfg.after)); err != nil {
+			utils.Log.Debug("Error : Failed to schedule channel fallback")
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordStatusTransition stores a status twilio reported for one attempt of the current verification,
+// reports for an older verification are dropped. Transitions are appended to a list so concurrent
+// callbacks do not overwrite each other
+func RecordStatusTransition(ctx context.Context, identifier string, verificationID string, transition StatusTransition) error {
+	metrics.MessageStatuses.WithLabelValues(transition.Status, transition.ErrorCode).Inc()
+	delivery, err := GetDelivery(ctx, identifier)
+	if err != nil {
+		return err
+	}
+	if delivery == nil || delivery.VerificationID != verificationID || transition.Attempt >= len(delivery.Attempts) {
+		utils.Log.Debug("Status transition skipped, verification is not the current one")
+		return nil
+	}
+	expiry, err := deliveryExpiry(ctx, identifier)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(transition)
+	if err != nil {
+		return err
+	}
+	if err := pushToCache(ctx, utils.GetDeliveryStatusKey(identifier, verificationID), string(value), expiry); err != nil {
+		utils.Log.Debug("Error : Failed to store status transition in cache")
+		return err
+	}
+	utils.Log.Debug("Successfully stored status transition in cache")
+	return nil
+}
+
+// GetDeliveryStatus returns the delivery of the current code with the status transitions twilio
+// reported merged into its attempts, nil when there is no current code
+func GetDeliveryStatus(ctx context.Context, identifier string) (*Delivery, error) {
+	delivery, err := GetDelivery(ctx, identifier)
+	if err != nil || delivery == nil {
+		return delivery, err
+	}
+	values, err := getCachedList(ctx, utils.GetDeliveryStatusKey(identifier, delivery.VerificationID))
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		var transition StatusTransition
+		if err := json.Unmarshal([]byte(value), &transition); err != nil {
+			return nil, err
+		}
+		if transition.Attempt < 0 || transition.Attempt >= len(delivery.Attempts) {
+			continue
+		}
+		attempt := &delivery.Attempts[transition.Attempt]
+		attempt.Transitions = append(attempt.Transitions, transition)
+		if statusRank[transition.Status] >= statusRank[attempt.Status] {
+			attempt.Status = transition.Status
+		}
+		if transition.ErrorCode != "" {
+			attempt.ErrorCode = transition.ErrorCode
+		}
+	}
+	return delivery, nil
+}
+
+// FallBack re-sends the current code on the next configured channel when attempt is still the latest
+// one of the verification and the code was neither verified nor expired. The same code and expiry are
+// kept, and a guard key makes sure only one trigger on one instance falls back per attempt
+func FallBack(ctx context.Context, identifier string, verificationID string, attempt int, trigger string) error {
+	cfg, err := getFallbackConfig()
+	if err != nil || !cfg.enabled {
+		return err
+	}
+	return fallBack(ctx, identifier, verificationID, attempt, trigger, func(delivery *Delivery) string {
+		return nextChannel(cfg.channels, delivery)
+	})
+}
+
+// FallBackToSMS re-sends the current code by sms once twilio reported that the whatsapp message of attempt
+// did not reach the number because it is not on whatsapp. Like the fallback of the whatsapp sender when
+// twilio refuses the message right away, it does not depend on otp-fallback-enabled
+func FallBackToSMS(ctx context.Context, identifier string, verificationID string, attempt int) error {
+	return fallBack(ctx, identifier, verificationID, attempt, TRIGGER_STATUS_CALLBACK, func(delivery *Delivery) string {
+		if delivery.Attempts[attempt].Channel != sender.WHATSAPP || !channelSupported(sender.SMS) {
+			return ""
+		}
+		for _, channel := range delivery.Channels() {
+			if channel == sender.SMS {
+				return ""
+			}
+		}
+		return sender.SMS
+	})
+}
+
+// fallBack sends the code on the channel next picks for the latest attempt of the verification
+func fallBack(ctx context.Context, identifier string, verificationID string, attempt int, trigger string, next func(*Delivery) string) error {
+	delivery, err := GetDelivery(ctx, identifier)
+	if err != nil || delivery == nil {
+		return err
+	}
+	if delivery.VerificationID != verificationID || attempt != len(delivery.Attempts)-1 {
+		utils.Log.Debug("Fallback skipped, attempt is not the latest one")
+		return nil
+	}
+	code, err := GetCachedOTPCode(ctx, identifier)
+	if err != nil || code == "" {
+		utils.Log.Debug("Fallback skipped, code verified or expired")
+		return err
+	}
+	channel := next(delivery)
+	if channel == "" {
+		utils.Log.Info("No channel left to fall back to")
+		return nil
+	}
+	ttl, err := getTTLData(ctx, utils.GetOTPCodeKey(identifier))
+	if err != nil || ttl <= 0 {
+		return err
+	}
+	first, err := storeInCacheIfAbsent(ctx, utils.GetFallbackKey(identifier, verificationID, attempt), true, ttl)
+	if err != nil || !first {
+		return err
+	}
+	//a fallback is one more message to the user and counts against the send limit like a resend
+	_, taken, err := takeSendLimit(ctx, identifier)
+	if err != nil {
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			utils.Log.Info("Fallback skipped, send limit reached")
+			metrics.Fallbacks.WithLabelValues(trigger, channel, "limited").Inc()
+			return nil
+		}
+		return err
+	}
+
+	utils.Log.Info(fmt.Sprintf("Falling back from %s to %s, trigger : %s", delivery.Attempts[attempt].Channel, channel, trigger))
+	var res sender.Result
+	var sendErr error
+	if verifyService != nil {
+		//twilio verify resends the code of the pending verification
+		res, sendErr = startVerification(ctx, delivery.Destination, channel)
+		if sendErr == nil {
+			updateVerificationSid(ctx, identifier, code, res.MessageID)
+		}
+	} else {
+		res, sendErr = sendCode(ctx, identifier, delivery, code, channel)
+	}
+	metrics.Fallbacks.WithLabelValues(trigger, channel, metrics.Outcome(sendErr)).Inc()
+	if sendErr != nil {
+		taken.refund(ctx)
+		utils.Log.Info(fmt.Sprintf("Fallback to %s failed, trying the next channel", channel))
+		res = sender.Result{Status: "failed"}
+	}
+	if err := recordAttempt(ctx, identifier, delivery, channel, trigger, res); err != nil {
+		return err
+	}
+	if sendErr != nil {
+		if err := FallBack(ctx, identifier, verificationID, attempt+1, trigger); err != nil {
+			return err
+		}
+		//nothing went out after this attempt, so the code did not reach the user on any channel
+		latest, err := GetDelivery(ctx, identifier)
+		if err != nil {
+			return err
+		}
+		if latest != nil && latest.VerificationID == verificationID && len(latest.Attempts) == attempt+2 {
+			recordFailedSend(ctx, delivery.Destination, channel, delivery.Language, sendErr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"github.com/twilio/twilio-go/client"
+)
+
+// twilio error codes with a status of their own, see https://www.twilio.com/docs/api/errors
+var twilioErrorStatus = map[int]int{
+	20429: http.StatusTooManyRequests, // too many requests
+	21211: http.StatusBadRequest,      // invalid 'To' phone number
+	21408: http.StatusBadRequest,      // sending to this region is not enabled
+	21610: http.StatusForbidden,       // recipient unsubscribed
+	21614: http.StatusBadRequest,      // 'To' number is not a mobile number
+	60200: http.StatusBadRequest,      // invalid verify parameter
+	60203: http.StatusTooManyRequests, // max verify send attempts reached
+	60410: http.StatusForbidden,       // verify delivery blocked by fraud guard
+}
+
+// providerErrorStatus maps an error of a message provider to a response status and message. Rejected
+// destinations become 4xx, failures of the provider itself 502, ok is false for other errors. The body
+// an HTTP provider answered with is only logged, it may hold details of the provider account
+func providerErrorStatus(err error) (int, string, bool) {
+	var restErr *client.TwilioRestError
+	var providerErr *sender.HTTPProviderError
+	var smtpErr *textproto.Error
+	switch {
+	case errors.Is(err, sender.ErrUnsupportedChannel):
+		return http.StatusBadRequest, err.Error(), true
+	case errors.As(err, &restErr):
+		if status, ok := twilioErrorStatus[restErr.Code]; ok {
+			return status, fmt.Sprintf("Message provider rejected the request : %d %s", restErr.Code, restErr.Message), true
+		}
+		return http.StatusBadGateway, fmt.Sprintf("Message provider failed : %d %s", restErr.Code, restErr.Message), true
+	case errors.As(err, &providerErr):
+		utils.Log.Warn(fmt.Sprintf("Message provider error : %s", err.Error()))
+		switch providerErr.StatusCode {
+		case http.StatusBadRequest, http.StatusUnprocessableEntity:
+			return http.StatusBadRequest, fmt.Sprintf("Message provider rejected the request : status %d", providerErr.StatusCode), true
+		case http.StatusTooManyRequests:
+			return http.StatusTooManyRequests, "Message provider rate limited the request", true
+		default:
+			return http.StatusBadGateway, fmt.Sprintf("Message provider failed : status %d", providerErr.StatusCode), true
+		}
+	case errors.As(err, &smtpErr):
+		//5xx replies are permanent, e.g. an unknown mailbox, 4xx ones transient
+		if smtpErr.Code >= 500 {
+			return http.StatusBadRequest, fmt.Sprintf("Mail server rejected the address : %d %s", smtpErr.Code, smtpErr.Msg), true
+		}
+		return http.StatusServiceUnavailable, fmt.Sprintf("Mail server unavailable : %d %s", smtpErr.Code, smtpErr.Msg), true
+	default:
+		return 0, "", false
+	}
+}
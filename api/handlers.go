@@ -2,12 +2,24 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/breaker"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/config"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/database"
 	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/response"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/store"
 	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"github.com/twilio/twilio-go/client"
 )
 
 //handler function for send otp
@@ -16,7 +28,7 @@ const appTimeout = time.Second * 10
 
 func SendOTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	_, cancel := context.WithTimeout(context.Background(), appTimeout)
+	ctx, cancel := context.WithTimeout(r.Context(), appTimeout)
 	defer cancel()
 
 	var data OTPData
@@ -32,98 +44,85 @@ func SendOTP(w http.ResponseWriter, r *http.Request) {
 		res.WriteJSON(w, http.StatusBadRequest)
 		return
 	}
+	if err := data.CheckIdentifier(); err != nil {
+		utils.Log.Info("Error : Invalid identifier or channel in request")
+		res = response.ErrorResponse{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: err.Error(),
+		}
+		res.WriteJSON(w, http.StatusBadRequest)
+		return
+	}
 	utils.Log.Info("Successfully Parsed and validated json body from request")
 
-	//Handle locked phone number efficiently
-	isLocked, ttl, err := GetOTPLock(data.PhoneNumber)
+	//Handle locked identifier efficiently
+	lock, err := GetOTPLock(ctx, data.Identifier())
 	if err != nil {
 		utils.Log.Info("Error : Failed to fetch lock data from cache")
-		res = response.ErrorResponse{
-			StatusCode:   http.StatusInternalServerError,
-			ErrorMessage: string(err.Error()),
-		}
-		res.WriteJSON(w, http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 	// if is locked return forbidden response with expiry time left
-	if isLocked {
-		utils.Log.Info("Phone number is locked")
-		res = response.SuccessResponse[TimeData]{
-			StatusCode: http.StatusForbidden,
-			Message:    fmt.Sprintf("User is prohibted to make any OTP request, Try after %d minutes", ttl),
-			Data: TimeData{
-				User: &data,
-				TTL:  ttl,
-			},
-		}
-		res.WriteJSON(w, http.StatusForbidden)
+	if lock != nil {
+		utils.Log.Info("User is locked")
+		writeLocked(w, &data, fmt.Sprintf("User is prohibted to make any OTP request, Try after %d minutes", lock.Minutes()), lock)
 		return
 	}
-	utils.Log.Info("Phone number is not locked")
-
-	//create OTP Message
-	OTPCode := utils.CreateOTPString(6)
-	utils.Log.Info("Successfully created OTP Code")
+	utils.Log.Info("User is not locked")
 
-	//put otp in cache
-	if err := SetOTPInCache(data.PhoneNumber, OTPCode); err != nil {
-		utils.Log.Info("Error : Failed to store OTP in cache ")
-		res = response.ErrorResponse{
-			StatusCode:   http.StatusInternalServerError,
-			ErrorMessage: string(err.Error()),
-		}
-		res.WriteJSON(w, http.StatusInternalServerError)
+	//every new code counts against the code and send limits of the user
+	remaining, taken, err := TakeIssueLimits(ctx, data.Identifier())
+	if err != nil {
+		utils.Log.Info("Error : Send refused by a limit")
+		writeError(w, err)
 		return
 	}
-	utils.Log.Info("Successfully stored OTP code in cache")
 
-	//send otp to phone number : catch error
-	if _, err := SendOTPMessage(data.PhoneNumber, OTPCode); err != nil {
-		utils.Log.Info("Error : Failed to send OTP message")
-		res = response.ErrorResponse{
-			StatusCode:   http.StatusInternalServerError,
-			ErrorMessage: string(err.Error()),
+	//async mode caches the code and leaves the delivery to the send workers
+	if sendQueue != nil {
+		delivery, otpTrials, err := EnqueueOTP(ctx, data, taken)
+		if err != nil {
+			utils.Log.Info("Error : Failed to queue OTP message")
+			taken.refund(ctx)
+			writeError(w, err)
+			return
 		}
-		res.WriteJSON(w, http.StatusInternalServerError)
+		utils.Log.Info("Successfully queued OTP message")
+		remaining.Guesses = &otpTrials
+		res = response.SuccessResponse[TrialsLeft]{
+			StatusCode: http.StatusAccepted,
+			Message:    "OTP message queued",
+			Data: TrialsLeft{
+				User:           &data,
+				Trials:         otpTrials,
+				VerificationID: delivery.VerificationID,
+				Remaining:      remaining,
+			},
+		}
+		res.WriteJSON(w, http.StatusAccepted)
 		return
 	}
-	utils.Log.Info("Successfully send OTP message to user")
 
-	//check number of tries in cache if empty set max tries
-	otpTrials, err := GetOTPTrialsLeft(data.PhoneNumber)
+	//create, cache and send otp to the user and set max trials if not set, nothing is kept when any step fails
+	delivery, otpTrials, err := IssueOTP(ctx, data)
 	if err != nil {
-		utils.Log.Info("Error : Failed to fetch OTP trials left from cache")
-		res = response.ErrorResponse{
-			StatusCode:   http.StatusInternalServerError,
-			ErrorMessage: string(err.Error()),
-		}
-		res.WriteJSON(w, http.StatusInternalServerError)
+		utils.Log.Info("Error : Failed to send OTP message")
+		taken.refund(ctx)
+		writeError(w, err)
 		return
 	}
-
-	//Check if OTP trials not set in cache
-	if otpTrials == -1 {
-		//set max otp trials
-		otpTrials, err = SetMaxOTPTrials(data.PhoneNumber)
-		if err != nil {
-			utils.Log.Info("Error : Failed to set OTP trials left to max")
-			res = response.ErrorResponse{
-				StatusCode:   http.StatusInternalServerError,
-				ErrorMessage: string(err.Error()),
-			}
-			res.WriteJSON(w, http.StatusInternalServerError)
-			return
-		}
-		utils.Log.Info("Successfully set OTP trials left to max")
-	}
-	utils.Log.Info(fmt.Sprintf("Successfully fetched OTP trials left : %d", otpTrials))
+	utils.Log.Info("Successfully send OTP message to user")
+	utils.Log.Info(fmt.Sprintf("OTP trials left : %d", otpTrials))
+	remaining.Guesses = &otpTrials
 	//send otp send success message
 	res = response.SuccessResponse[TrialsLeft]{
 		StatusCode: http.StatusOK,
 		Message:    "Successfully send OTP message",
 		Data: TrialsLeft{
-			User:   &data,
-			Trials: otpTrials,
+			User:           &data,
+			Trials:         otpTrials,
+			VerificationID: delivery.VerificationID,
+			Remaining:      remaining,
 		},
 	}
 	res.WriteJSON(w, http.StatusOK)
@@ -132,7 +131,7 @@ func SendOTP(w http.ResponseWriter, r *http.Request) {
 // handler funtion fot verify otp
 func VerifyOTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	_, cancel := context.WithTimeout(context.Background(), appTimeout)
+	ctx, cancel := context.WithTimeout(r.Context(), appTimeout)
 	defer cancel()
 
 	var data VerifyData
@@ -148,227 +147,451 @@ func VerifyOTP(w http.ResponseWriter, r *http.Request) {
 		res.WriteJSON(w, http.StatusBadRequest)
 		return
 	}
+	if err := data.User.CheckIdentifier(); err != nil {
+		utils.Log.Info("Error : Invalid identifier in request")
+		res = response.ErrorResponse{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: err.Error(),
+		}
+		res.WriteJSON(w, http.StatusBadRequest)
+		return
+	}
 	utils.Log.Info("Successfully Parsed and validated json body from request")
 
-	//if locked
-	isLocked, ttl, err := GetOTPLock(data.User.PhoneNumber)
+	//check lock, code and trials left in a single step so concurrent requests can not reuse a code or trial
+	result, err := VerifyOTPCode(ctx, data.User.Identifier(), data.Code)
 	if err != nil {
-		utils.Log.Info("Error : Failed to fetch lock data from cache")
+		utils.Log.Info("Error : Failed to verify OTP code")
+		writeError(w, err)
+		return
+	}
+
+	switch {
+	// if is locked return forbidden response with expiry time left
+	case result.Outcome == store.Locked:
+		utils.Log.Info("User is locked")
+		lock := &OTPLock{TTL: result.LockTTL, Level: result.LockLevel}
+		writeLocked(w, data.User, fmt.Sprintf("User is prohibted to make any OTP request, Try after %d minutes", lock.Minutes()), lock)
+
+	//last trial used, user is now locked for the duration of its lock level
+	case result.LockedNow:
+		utils.Log.Info(fmt.Sprintf("Max trial limit reached, user locked at level %d", result.LockLevel))
+		lock := &OTPLock{TTL: result.LockTTL, Level: result.LockLevel}
+		message := fmt.Sprintf("Incorrect OTP and Max Limit Reached, Try after %d minutes", lock.Minutes())
+		if result.Outcome == store.Expired {
+			message = fmt.Sprintf("OTP Expired and Max Limit Reached, Try after %d minutes", lock.Minutes())
+		}
+		writeLocked(w, data.User, message, lock)
+
+	//if otp data not present in cache , it has expired
+	case result.Outcome == store.Expired:
+		utils.Log.Info("OTP expired")
+		res = response.SuccessResponse[TrialsLeft]{
+			StatusCode: http.StatusUnauthorized,
+			Message:    "OTP Expired, Try Again",
+			Data: TrialsLeft{
+				User:   data.User,
+				Trials: result.TrialsLeft,
+			},
+		}
+		res.WriteJSON(w, http.StatusUnauthorized)
+
+	//if otp != otp in cache
+	case result.Outcome == store.Incorrect:
+		utils.Log.Info("Incorrect OTP")
+		res = response.SuccessResponse[TrialsLeft]{
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Incorrect OTP, Try Again",
+			Data: TrialsLeft{
+				User:   data.User,
+				Trials: result.TrialsLeft,
+			},
+		}
+		res.WriteJSON(w, http.StatusUnauthorized)
+
+	default:
+		utils.Log.Info("User is successfully verified")
+		res = response.SuccessResponse[string]{
+			StatusCode: http.StatusOK,
+			Message:    "Successfully verified user",
+			Data:       data.User.Destination(),
+		}
+		res.WriteJSON(w, http.StatusOK)
+	}
+}
+
+// writeLocked writes the forbidden response of a locked user with the time left and the lock level
+func writeLocked(w http.ResponseWriter, user *OTPData, message string, lock *OTPLock) {
+	res := response.SuccessResponse[TimeData]{
+		StatusCode: http.StatusForbidden,
+		Message:    message,
+		Data: TimeData{
+			User:  user,
+			TTL:   lock.Minutes(),
+			Level: lock.Level,
+		},
+	}
+	res.WriteJSON(w, http.StatusForbidden)
+}
+
+// handler function re-sending the current code, on another channel when one is given
+func ResendOTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	ctx, cancel := context.WithTimeout(r.Context(), appTimeout)
+	defer cancel()
+
+	var data VerificationRequest
+	var res response.Responder
+
+	if err := utils.ParseAndValidateBody(r, &data); err != nil {
+		utils.Log.Info("Error : Failed to parse json body from request")
 		res = response.ErrorResponse{
-			StatusCode:   http.StatusInternalServerError,
+			StatusCode:   http.StatusBadRequest,
 			ErrorMessage: string(err.Error()),
 		}
-		res.WriteJSON(w, http.StatusInternalServerError)
+		res.WriteJSON(w, http.StatusBadRequest)
 		return
 	}
-	// if is locked return forbidden response with expiry time left
-	if isLocked {
-		utils.Log.Info("Phone number is locked")
-		res = response.SuccessResponse[TimeData]{
-			StatusCode: http.StatusForbidden,
-			Message:    fmt.Sprintf("User is prohibted to make any OTP request, Try after %d minutes", ttl),
-			Data: TimeData{
-				User: data.User,
-				TTL:  ttl,
-			},
+	if err := data.CheckIdentifier(); err != nil {
+		utils.Log.Info("Error : Invalid identifier or channel in request")
+		res = response.ErrorResponse{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: err.Error(),
 		}
-		res.WriteJSON(w, http.StatusForbidden)
+		res.WriteJSON(w, http.StatusBadRequest)
 		return
 	}
-	utils.Log.Info("Phone number is not locked")
 
-	// Get cached otp
-	cachedOTP, err := GetCachedOTPCode(data.User.PhoneNumber)
+	outcome, resend, err := ResendOTPCode(ctx, data.Identifier(), data.VerificationID, data.Channel)
 	if err != nil {
-		utils.Log.Info("Error : Failed to fetch OTP code from cache")
+		utils.Log.Info("Error : Failed to resend OTP message")
+		writeError(w, err)
+		return
+	}
+	if resend != nil {
+		resend.User = &data.OTPData
+	}
+	writeResend(w, outcome, resend)
+}
+
+// writeResend writes the response of a resend, a resend that came too soon has Retry-After set
+func writeResend(w http.ResponseWriter, outcome string, data *ResendData) {
+	var res response.Responder
+	switch outcome {
+	case RESEND_NO_CODE:
+		utils.Log.Info("No active code to resend")
 		res = response.ErrorResponse{
-			StatusCode:   http.StatusInternalServerError,
-			ErrorMessage: string(err.Error()),
+			StatusCode:   http.StatusNotFound,
+			ErrorMessage: "No active code for user",
+		}
+		res.WriteJSON(w, http.StatusNotFound)
+	case RESEND_LIMIT:
+		utils.Log.Info("Resend limit reached")
+		res = response.SuccessResponse[*ResendData]{
+			StatusCode: http.StatusTooManyRequests,
+			Message:    "Resend limit reached, request a new code",
+			Data:       data,
+		}
+		res.WriteJSON(w, http.StatusTooManyRequests)
+	case RESEND_TOO_SOON:
+		utils.Log.Info("Resend requested too soon")
+		wait := max(1, int(math.Ceil(time.Until(*data.NextResendAt).Seconds())))
+		w.Header().Set("Retry-After", strconv.Itoa(wait))
+		res = response.SuccessResponse[*ResendData]{
+			StatusCode: http.StatusTooManyRequests,
+			Message:    fmt.Sprintf("Resend not allowed yet, Try after %d seconds", wait),
+			Data:       data,
+		}
+		res.WriteJSON(w, http.StatusTooManyRequests)
+	default:
+		utils.Log.Info("Successfully resent OTP message")
+		res = response.SuccessResponse[*ResendData]{
+			StatusCode: http.StatusOK,
+			Message:    "Successfully resent OTP message",
+			Data:       data,
 		}
-		res.WriteJSON(w, http.StatusInternalServerError)
+		res.WriteJSON(w, http.StatusOK)
+	}
+}
+
+// handler function twilio calls to fetch the script of an OTP voice call
+func VoiceTwiML(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), appTimeout)
+	defer cancel()
+
+	identifier := utils.GetIdentifier(utils.PHONE, r.URL.Query().Get("to"))
+	token, err := GetVoiceToken(ctx, identifier)
+	if err != nil {
+		utils.Log.Info("Error : Failed to fetch voice token from cache")
+		writeError(w, err)
+		return
+	}
+	if token == nil || subtle.ConstantTimeCompare([]byte(token.Token), []byte(r.URL.Query().Get("token"))) != 1 {
+		utils.Log.Info("Voice TwiML requested with unknown token")
+		res := response.ErrorResponse{
+			StatusCode:   http.StatusForbidden,
+			ErrorMessage: "Unknown voice token",
+		}
+		res.WriteJSON(w, http.StatusForbidden)
 		return
 	}
-	utils.Log.Info("Fetched OTP code from cache")
 
-	//if otp data not present in cache , it has expired
-	if cachedOTP == "" {
-		utils.Log.Info("OTP expired")
-		//fetch trials left
-		trialsLeft, err := GetOTPTrialsLeft(data.User.PhoneNumber)
-		if err != nil {
-			utils.Log.Info("Error : Failed to fetch OTP trials left from cache")
-			res = response.ErrorResponse{
-				StatusCode:   http.StatusInternalServerError,
-				ErrorMessage: string(err.Error()),
-			}
-			res.WriteJSON(w, http.StatusInternalServerError)
-			return
+	OTPCode, err := GetCachedOTPCode(ctx, identifier)
+	if err != nil {
+		utils.Log.Info("Error : Failed to fetch OTP code from cache")
+		writeError(w, err)
+		return
+	}
+
+	var script string
+	if OTPCode == "" {
+		utils.Log.Info("OTP expired before the call was answered")
+		script, err = sender.ExpiredTwiML()
+	} else {
+		script, err = sender.VoiceTwiML(OTPCode, token.Language)
+	}
+	if err != nil {
+		utils.Log.Info("Error : Failed to build voice TwiML")
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(script))
+	utils.Log.Info("Successfully served voice TwiML")
+}
+
+// handler function twilio calls with the delivery status of an OTP message, a whatsapp message to a number
+// that is not on whatsapp falls back to sms, a failed or undelivered message falls back to the next
+// channel when fallback is enabled
+func MessageStatus(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	ctx, cancel := context.WithTimeout(r.Context(), appTimeout)
+	defer cancel()
+
+	if err := r.ParseForm(); err != nil {
+		utils.Log.Info("Error : Failed to parse status callback form")
+		res := response.ErrorResponse{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: err.Error(),
 		}
-		utils.Log.Info("Successfully fetched OTP trials left from cache")
-
-		//if trial left is 1, Max limit reached
-		if trialsLeft == 1 {
-			utils.Log.Info("Max trial Limit reached")
-
-			//perform cleanup
-			if err := CleanUp(data.User.PhoneNumber); err != nil {
-				utils.Log.Info("Error : Failed to set OTP lock in cache")
-				res = response.ErrorResponse{
-					StatusCode:   http.StatusInternalServerError,
-					ErrorMessage: string(err.Error()),
-				}
-				res.WriteJSON(w, http.StatusInternalServerError)
-				return
-			}
-			utils.Log.Info("Successfully CleanedUp")
-
-			//set otp lock for 30 min
-			if err := SetOTPLock(data.User.PhoneNumber, true); err != nil {
-				utils.Log.Info("Error : Failed to set OTP lock in cache")
-				res = response.ErrorResponse{
-					StatusCode:   http.StatusInternalServerError,
-					ErrorMessage: string(err.Error()),
-				}
-				res.WriteJSON(w, http.StatusInternalServerError)
-				return
-			}
-			utils.Log.Info("Successfully locked phone number")
-
-			//send forbidden response with expiry time
-			res = response.SuccessResponse[TimeData]{
-				StatusCode: http.StatusForbidden,
-				Message:    "OTP Expired and Max Limit Reached, Try after 30 min",
-				Data: TimeData{
-					User: data.User,
-					TTL:  30,
-				},
-			}
-			res.WriteJSON(w, http.StatusInternalServerError)
-			return
+		res.WriteJSON(w, http.StatusBadRequest)
+		return
+	}
+	if !validTwilioSignature(r) {
+		utils.Log.Info("Status callback with invalid twilio signature")
+		res := response.ErrorResponse{
+			StatusCode:   http.StatusForbidden,
+			ErrorMessage: "Invalid twilio signature",
 		}
+		res.WriteJSON(w, http.StatusForbidden)
+		return
+	}
 
-		//decrement the trials left
-		if err = DecrementOTPTrialsLeft(data.User.PhoneNumber); err != nil {
-			utils.Log.Info("Error : Failed to Decrement OTP trials left in cache")
-			res = response.ErrorResponse{
-				StatusCode:   http.StatusInternalServerError,
-				ErrorMessage: string(err.Error()),
-			}
-			res.WriteJSON(w, http.StatusInternalServerError)
-			return
+	query := r.URL.Query()
+	attempt, err := strconv.Atoi(query.Get("attempt"))
+	if err != nil {
+		utils.Log.Info("Error : Invalid attempt in status callback")
+		res := response.ErrorResponse{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: "Invalid attempt",
 		}
-		utils.Log.Info("Successfully decremented OTP trials left in cache")
+		res.WriteJSON(w, http.StatusBadRequest)
+		return
+	}
+	transition := StatusTransition{
+		Attempt:   attempt,
+		MessageID: r.PostForm.Get("MessageSid"),
+		Status:    r.PostForm.Get("MessageStatus"),
+		ErrorCode: r.PostForm.Get("ErrorCode"),
+		At:        time.Now().UTC(),
+	}
+	utils.Log.Info(fmt.Sprintf("Message status callback, status : %s, error code : %s", transition.Status, transition.ErrorCode))
 
-		//forbidden response with trials left
-		res = response.SuccessResponse[TrialsLeft]{
-			StatusCode: http.StatusUnauthorized,
-			Message:    "OTP Expired, Try Again",
-			Data: TrialsLeft{
-				User:   data.User,
-				Trials: trialsLeft - 1,
-			},
-		}
-		res.WriteJSON(w, http.StatusInternalServerError)
+	callbackRef, err := GetStatusCallbackRef(ctx, query.Get("ref"))
+	if err != nil {
+		utils.Log.Info("Error : Failed to fetch status callback ref from cache")
+		writeError(w, err)
 		return
 	}
-	//if otp != otp in cache
-	if cachedOTP != data.Code {
-		utils.Log.Info("Incorrect OTP")
-		//get trials left
-		trialsLeft, err := GetOTPTrialsLeft(data.User.PhoneNumber)
-		if err != nil {
-			utils.Log.Info("Error : Failed to fetch OTP trials left from cache")
-			res = response.ErrorResponse{
-				StatusCode:   http.StatusInternalServerError,
-				ErrorMessage: string(err.Error()),
-			}
-			res.WriteJSON(w, http.StatusInternalServerError)
+	if callbackRef == nil {
+		//the code expired, there is nothing left to update
+		utils.Log.Info("Status callback for an unknown or expired ref")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	identifier, verificationID := callbackRef.Identifier, callbackRef.VerificationID
+
+	if err := RecordStatusTransition(ctx, identifier, verificationID, transition); err != nil {
+		utils.Log.Info("Error : Failed to store message status")
+		writeError(w, err)
+		return
+	}
+	if sender.NotOnWhatsApp(transition.ErrorCode) {
+		if err := FallBackToSMS(ctx, identifier, verificationID, attempt); err != nil {
+			utils.Log.Info("Error : Failed to fall back to sms")
+			writeError(w, err)
 			return
 		}
-		utils.Log.Info("Successfully fetched OTP trials left from cache")
-
-		//if trials left is 1, max limit reached
-		if trialsLeft == 1 {
-			utils.Log.Info("Max trial limit reached")
-
-			//perform cleanup
-			if err := CleanUp(data.User.PhoneNumber); err != nil {
-				utils.Log.Info("Error : Failed to set OTP lock in cache")
-				res = response.ErrorResponse{
-					StatusCode:   http.StatusInternalServerError,
-					ErrorMessage: string(err.Error()),
-				}
-				res.WriteJSON(w, http.StatusInternalServerError)
-				return
-			}
-			utils.Log.Info("Successfully CleanedUp")
-
-			//set otp lock for 30 min
-			if err := SetOTPLock(data.User.PhoneNumber, true); err != nil {
-				utils.Log.Info("Error : Failed to set OTP lock in cache")
-				res = response.ErrorResponse{
-					StatusCode:   http.StatusInternalServerError,
-					ErrorMessage: string(err.Error()),
-				}
-				res.WriteJSON(w, http.StatusInternalServerError)
-				return
-			}
-			utils.Log.Info("Successfully locked phone number")
-
-			//forbidden response with expiry time
-			res = response.SuccessResponse[TimeData]{
-				StatusCode: http.StatusForbidden,
-				Message:    "Incorrect OTP and Max Limit Reached Try after 30 min",
-				Data: TimeData{
-					User: data.User,
-					TTL:  30,
-				},
-			}
-			res.WriteJSON(w, http.StatusInternalServerError)
+	}
+	if notDelivered[transition.Status] {
+		if err := FallBack(ctx, identifier, verificationID, attempt, TRIGGER_STATUS_CALLBACK); err != nil {
+			utils.Log.Info("Error : Failed to fall back to the next channel")
+			writeError(w, err)
 			return
 		}
-		//decrement the trials left
-		if err = DecrementOTPTrialsLeft(data.User.PhoneNumber); err != nil {
-			utils.Log.Info("Error : Failed to Decrement OTP trials left in cache")
-			res = response.ErrorResponse{
-				StatusCode:   http.StatusInternalServerError,
-				ErrorMessage: string(err.Error()),
-			}
-			res.WriteJSON(w, http.StatusInternalServerError)
-			return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validTwilioSignature checks X-Twilio-Signature against the public url twilio called and the form params
+func validTwilioSignature(r *http.Request) bool {
+	authToken, ok := config.GetTwilioAuthToken()
+	if !ok {
+		utils.Log.Warn("TWILIO_AUTHTOKEN not set, can not validate twilio signatures")
+		return false
+	}
+	baseURL, err := utils.GetStringFromConf("public-base-url", "")
+	if err != nil || baseURL == "" {
+		return false
+	}
+	params := make(map[string]string, len(r.PostForm))
+	for key := range r.PostForm {
+		params[key] = r.PostForm.Get(key)
+	}
+	validator := client.NewRequestValidator(authToken)
+	return validator.Validate(strings.TrimSuffix(baseURL, "/")+r.URL.RequestURI(), params, r.Header.Get("X-Twilio-Signature"))
+}
+
+// handler function for the delivery attempts of the current code of a user
+func OTPStatus(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	ctx, cancel := context.WithTimeout(r.Context(), appTimeout)
+	defer cancel()
+
+	var data VerificationRequest
+	var res response.Responder
+
+	if err := utils.ParseAndValidateBody(r, &data); err != nil {
+		utils.Log.Info("Error : Failed to parse json body from request")
+		res = response.ErrorResponse{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: string(err.Error()),
 		}
-		utils.Log.Info("Successfully decremented OTP trials left in cache")
-		//forbidden response with trials left
-		res = response.SuccessResponse[TrialsLeft]{
-			StatusCode: http.StatusUnauthorized,
-			Message:    "Incorrect OTP, Try Again",
-			Data: TrialsLeft{
-				User:   data.User,
-				Trials: trialsLeft - 1,
-			},
+		res.WriteJSON(w, http.StatusBadRequest)
+		return
+	}
+	if err := data.CheckIdentifier(); err != nil {
+		utils.Log.Info("Error : Invalid identifier in request")
+		res = response.ErrorResponse{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: err.Error(),
 		}
-		res.WriteJSON(w, http.StatusInternalServerError)
+		res.WriteJSON(w, http.StatusBadRequest)
 		return
 	}
 
-	utils.Log.Info("User is successfully verified")
-	//perform clean up >delete cached otp > delete cached trials
-	if err := CleanUp(data.User.PhoneNumber); err != nil {
-		utils.Log.Info("Error : Failed to set OTP lock in cache")
+	delivery, err := GetDeliveryStatus(ctx, data.Identifier())
+	if err != nil {
+		utils.Log.Info("Error : Failed to fetch delivery status from cache")
+		writeError(w, err)
+		return
+	}
+	if delivery == nil || delivery.VerificationID != data.VerificationID {
+		utils.Log.Info("No active code for verification")
 		res = response.ErrorResponse{
-			StatusCode:   http.StatusInternalServerError,
+			StatusCode:   http.StatusNotFound,
+			ErrorMessage: "No active code for user",
+		}
+		res.WriteJSON(w, http.StatusNotFound)
+		return
+	}
+
+	res = response.SuccessResponse[DeliveryStatus]{
+		StatusCode: http.StatusOK,
+		Message:    "Successfully fetched OTP delivery status",
+		Data: DeliveryStatus{
+			User:          &data.OTPData,
+			ChannelsTried: delivery.Channels(),
+			Attempts:      delivery.ClientAttempts(),
+		},
+	}
+	res.WriteJSON(w, http.StatusOK)
+}
+
+// handler function for redis connection pool stats
+func RedisPoolStats(w http.ResponseWriter, r *http.Request) {
+	var res response.Responder
+
+	stats, err := database.PoolStats()
+	if err != nil {
+		utils.Log.Info("Error : Redis pool stats not available")
+		res = response.ErrorResponse{
+			StatusCode:   http.StatusServiceUnavailable,
 			ErrorMessage: string(err.Error()),
 		}
-		res.WriteJSON(w, http.StatusInternalServerError)
+		res.WriteJSON(w, http.StatusServiceUnavailable)
 		return
 	}
-	utils.Log.Info("Successfully CleanedUp")
 
-	//send success message
-	res = response.SuccessResponse[string]{
+	res = response.SuccessResponse[PoolStats]{
 		StatusCode: http.StatusOK,
-		Message:    "Successfully verified user",
-		Data:       data.User.PhoneNumber,
+		Message:    "Successfully fetched redis pool stats",
+		Data: PoolStats{
+			Hits:       stats.Hits,
+			Misses:     stats.Misses,
+			Timeouts:   stats.Timeouts,
+			TotalConns: stats.TotalConns,
+			IdleConns:  stats.IdleConns,
+			StaleConns: stats.StaleConns,
+		},
 	}
 	res.WriteJSON(w, http.StatusOK)
 }
+
+// writeError maps an error from the service layer to an error response, timeouts and
+// unreachable dependencies are reported as 504 and 503 instead of a generic 500. An open provider
+// circuit breaker is a 503 and a request refused by a send or code limit a 429, both with Retry-After
+// so clients back off instead of waiting on timeouts
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	message := err.Error()
+
+	var netErr net.Error
+	var limitErr *LimitError
+	retryAfter, breakerOpen := breaker.RetryAfter(err)
+	providerStatus, providerMessage, providerErr := providerErrorStatus(err)
+	switch {
+	case breakerOpen:
+		status = http.StatusServiceUnavailable
+		message = "Message provider unavailable"
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+	case providerErr:
+		status = providerStatus
+		message = providerMessage
+	case errors.As(err, &limitErr):
+		wait := max(1, int(math.Ceil(limitErr.RetryAfter.Seconds())))
+		status = http.StatusTooManyRequests
+		message = fmt.Sprintf("Too many %s, Try after %d seconds", limitErr.Limit, wait)
+		w.Header().Set("Retry-After", strconv.Itoa(wait))
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+		message = "Request timed out waiting for a dependency"
+	case errors.Is(err, context.Canceled):
+		status = http.StatusServiceUnavailable
+		message = "Request canceled"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		status = http.StatusGatewayTimeout
+		message = fmt.Sprintf("Dependency timed out : %s", err.Error())
+	case errors.As(err, &netErr):
+		status = http.StatusServiceUnavailable
+		message = fmt.Sprintf("Dependency unavailable : %s", err.Error())
+	}
+
+	res := response.ErrorResponse{
+		StatusCode:   status,
+		ErrorMessage: message,
+	}
+	res.WriteJSON(w, status)
+}
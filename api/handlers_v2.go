@@ -0,0 +1,240 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/response"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+//v2 handlers work on verification resources, the v1 handlers on the identifier of the user
+
+// handler function creating a verification, sends a new code like send-otp
+func NewVerification(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	ctx, cancel := context.WithTimeout(r.Context(), appTimeout)
+	defer cancel()
+
+	var data OTPData
+	var res response.Responder
+
+	if err := utils.ParseAndValidateBody(r, &data); err != nil {
+		utils.Log.Info("Error : Failed to parse json body from request")
+		res = response.ErrorResponse{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: string(err.Error()),
+		}
+		res.WriteJSON(w, http.StatusBadRequest)
+		return
+	}
+	if err := data.CheckIdentifier(); err != nil {
+		utils.Log.Info("Error : Invalid identifier or channel in request")
+		res = response.ErrorResponse{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: err.Error(),
+		}
+		res.WriteJSON(w, http.StatusBadRequest)
+		return
+	}
+
+	lock, err := GetOTPLock(ctx, data.Identifier())
+	if err != nil {
+		utils.Log.Info("Error : Failed to fetch lock data from cache")
+		writeError(w, err)
+		return
+	}
+	if lock != nil {
+		utils.Log.Info("User is locked")
+		writeLocked(w, &data, fmt.Sprintf("User is prohibted to make any OTP request, Try after %d minutes", lock.Minutes()), lock)
+		return
+	}
+
+	remaining, taken, err := TakeIssueLimits(ctx, data.Identifier())
+	if err != nil {
+		utils.Log.Info("Error : Send refused by a limit")
+		writeError(w, err)
+		return
+	}
+
+	verification, err := CreateVerification(ctx, data, taken)
+	if err != nil {
+		utils.Log.Info("Error : Failed to create verification")
+		taken.refund(ctx)
+		writeError(w, err)
+		return
+	}
+	remaining.Guesses = &verification.TrialsLeft
+	verification.Remaining = remaining
+	utils.Log.Info("Successfully created verification")
+	writeVerification(w, http.StatusCreated, "Verification created", verification)
+}
+
+// handler function for the current status of a verification
+func VerificationStatus(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), appTimeout)
+	defer cancel()
+
+	verification, err := GetVerification(ctx, mux.Vars(r)["id"])
+	if err != nil {
+		utils.Log.Info("Error : Failed to fetch verification")
+		writeError(w, err)
+		return
+	}
+	if verification == nil {
+		writeVerificationNotFound(w)
+		return
+	}
+	writeVerification(w, http.StatusOK, "Successfully fetched verification", verification)
+}
+
+// handler function checking a code against a verification, a pending verification is approved,
+// stays pending with the trials left or gets locked
+func VerificationCheck(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	ctx, cancel := context.WithTimeout(r.Context(), appTimeout)
+	defer cancel()
+
+	var data CheckData
+	if err := utils.ParseAndValidateBody(r, &data); err != nil {
+		utils.Log.Info("Error : Failed to parse json body from request")
+		res := response.ErrorResponse{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: string(err.Error()),
+		}
+		res.WriteJSON(w, http.StatusBadRequest)
+		return
+	}
+
+	verification, checked, err := CheckVerification(ctx, mux.Vars(r)["id"], data.Code)
+	if err != nil {
+		utils.Log.Info("Error : Failed to check verification")
+		writeError(w, err)
+		return
+	}
+	if verification == nil {
+		writeVerificationNotFound(w)
+		return
+	}
+
+	switch {
+	case verification.Status == STATUS_LOCKED:
+		utils.Log.Info("User is locked")
+		writeVerification(w, http.StatusForbidden, fmt.Sprintf("Verification locked, Try after %d seconds", verification.LockTTL), verification)
+	case !checked:
+		writeVerification(w, http.StatusConflict, fmt.Sprintf("Verification is %s", verification.Status), verification)
+	case verification.Status == STATUS_APPROVED:
+		utils.Log.Info("User is successfully verified")
+		writeVerification(w, http.StatusOK, "Verification approved", verification)
+	case verification.Status == STATUS_EXPIRED:
+		utils.Log.Info("OTP expired")
+		writeVerification(w, http.StatusUnauthorized, "OTP Expired", verification)
+	default:
+		utils.Log.Info("Incorrect OTP")
+		writeVerification(w, http.StatusUnauthorized, "Incorrect OTP, Try Again", verification)
+	}
+}
+
+// handler function canceling a pending verification
+func VerificationCancel(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), appTimeout)
+	defer cancel()
+
+	verification, canceled, err := CancelVerification(ctx, mux.Vars(r)["id"])
+	if err != nil {
+		utils.Log.Info("Error : Failed to cancel verification")
+		writeError(w, err)
+		return
+	}
+	if verification == nil {
+		writeVerificationNotFound(w)
+		return
+	}
+	if !canceled {
+		writeVerification(w, http.StatusConflict, fmt.Sprintf("Verification is %s", verification.Status), verification)
+		return
+	}
+	utils.Log.Info("Successfully canceled verification")
+	writeVerification(w, http.StatusOK, "Verification canceled", verification)
+}
+
+// handler function re-sending the code of a pending verification, on another channel when one is given
+func VerificationResend(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	ctx, cancel := context.WithTimeout(r.Context(), appTimeout)
+	defer cancel()
+
+	//the body is optional
+	var data ResendChannel
+	if err := utils.ParseAndValidateBody(r, &data); err != nil && !errors.Is(err, io.EOF) {
+		utils.Log.Info("Error : Failed to parse json body from request")
+		res := response.ErrorResponse{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: string(err.Error()),
+		}
+		res.WriteJSON(w, http.StatusBadRequest)
+		return
+	}
+
+	verification, err := GetVerification(ctx, mux.Vars(r)["id"])
+	if err != nil {
+		utils.Log.Info("Error : Failed to fetch verification")
+		writeError(w, err)
+		return
+	}
+	if verification == nil {
+		writeVerificationNotFound(w)
+		return
+	}
+	if verification.Status != STATUS_PENDING {
+		writeVerification(w, http.StatusConflict, fmt.Sprintf("Verification is %s", verification.Status), verification)
+		return
+	}
+
+	user := OTPData{Channel: data.Channel}
+	if verification.Channel == sender.EMAIL {
+		user.Email = verification.To
+	} else {
+		user.PhoneNumber = verification.To
+	}
+	if err := user.CheckIdentifier(); err != nil {
+		utils.Log.Info("Error : Invalid channel in request")
+		res := response.ErrorResponse{
+			StatusCode:   http.StatusBadRequest,
+			ErrorMessage: err.Error(),
+		}
+		res.WriteJSON(w, http.StatusBadRequest)
+		return
+	}
+
+	outcome, resend, err := ResendOTPCode(ctx, user.Identifier(), verification.ID, data.Channel)
+	if err != nil {
+		utils.Log.Info("Error : Failed to resend OTP message")
+		writeError(w, err)
+		return
+	}
+	writeResend(w, outcome, resend)
+}
+
+func writeVerification(w http.ResponseWriter, status int, message string, verification *Verification) {
+	res := response.SuccessResponse[*Verification]{
+		StatusCode: status,
+		Message:    message,
+		Data:       verification,
+	}
+	res.WriteJSON(w, status)
+}
+
+func writeVerificationNotFound(w http.ResponseWriter) {
+	utils.Log.Info("Verification not found")
+	res := response.ErrorResponse{
+		StatusCode:   http.StatusNotFound,
+		ErrorMessage: "Verification not found",
+	}
+	res.WriteJSON(w, http.StatusNotFound)
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/health"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/response"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+var draining atomic.Bool
+
+var healthChecker = health.NewChecker(0, 0)
+
+// SetDraining marks the service as shutting down so readiness probes stop routing traffic to it
+func SetDraining(value bool) {
+	draining.Store(value)
+}
+
+// SetHealthChecker sets the dependency checks run by the liveness and readiness probes
+func SetHealthChecker(c *health.Checker) {
+	healthChecker = c
+}
+
+// handler function for liveness probe, only process local checks so a redis outage does not restart the service
+func Liveness(w http.ResponseWriter, r *http.Request) {
+	results, healthy := healthChecker.Liveness(r.Context())
+	writeHealth(w, results, healthy, "Service is alive", "Service is not alive")
+}
+
+// handler function for readiness probe
+func Readiness(w http.ResponseWriter, r *http.Request) {
+	var res response.Responder
+
+	if draining.Load() {
+		utils.Log.Debug("Readiness probe : service is draining")
+		res = response.SuccessResponse[HealthReport]{
+			StatusCode: http.StatusServiceUnavailable,
+			Message:    "Service is shutting down",
+			Data: HealthReport{
+				Status:   health.DOWN,
+				Draining: true,
+			},
+		}
+		res.WriteJSON(w, http.StatusServiceUnavailable)
+		return
+	}
+
+	results, healthy := healthChecker.Readiness(r.Context())
+	writeHealth(w, results, healthy, "Service is ready", "Service is not ready")
+}
+
+func writeHealth(w http.ResponseWriter, results []health.Result, healthy bool, upMessage string, downMessage string) {
+	report := HealthReport{
+		Status: health.UP,
+		Checks: results,
+	}
+	status := http.StatusOK
+	message := upMessage
+	if !healthy {
+		utils.Log.Info(downMessage)
+		report.Status = health.DOWN
+		status = http.StatusServiceUnavailable
+		message = downMessage
+	}
+
+	res := response.SuccessResponse[HealthReport]{
+		StatusCode: status,
+		Message:    message,
+		Data:       report,
+	}
+	res.WriteJSON(w, status)
+}
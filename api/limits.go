@@ -0,0 +1,198 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/queue"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+// rate limits of an identifier, wrong guesses are limited per code by otp-max-trials
+const (
+	LIMIT_SENDS = "sends"
+	LIMIT_CODES = "codes"
+)
+
+// rateLimit allows max events per rolling window. Once it is hit the identifier is locked out of
+// the limit for lock, or until the oldest event leaves the window when lock is 0
+type rateLimit struct {
+	name   string
+	max    int
+	window time.Duration
+	lock   time.Duration
+}
+
+// LimitError is a request refused by a rate limit, it can be retried after RetryAfter
+type LimitError struct {
+	Limit      string
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("too many %s, try again in %s", e.Limit, e.RetryAfter.Round(time.Second))
+}
+
+// takenLimits are the events a request counted against the limits of an identifier, refund gives
+// them back when the request ends up sending nothing
+type takenLimits struct {
+	hits []takenHit
+}
+
+type takenHit struct {
+	key string
+	id  string
+}
+
+// refund removes the events from their windows, it is safe on nil
+func (t *takenLimits) refund(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second*5)
+	defer cancel()
+	for _, hit := range t.hits {
+		if err := unhitInCache(ctx, hit.key, hit.id); err != nil {
+			utils.Log.Warn(fmt.Sprintf("Failed to refund limit : %s", err.Error()))
+		}
+	}
+	t.hits = nil
+}
+
+// queueHits returns the events for a queued job, so a worker can refund them
+func (t *takenLimits) queueHits() []queue.LimitHit {
+	if t == nil {
+		return nil
+	}
+	hits := make([]queue.LimitHit, 0, len(t.hits))
+	for _, hit := range t.hits {
+		hits = append(hits, queue.LimitHit{Key: hit.key, ID: hit.id})
+	}
+	return hits
+}
+
+// takenByJob returns the events a queued job was counted as
+func takenByJob(job *queue.Job) *takenLimits {
+	taken := &takenLimits{}
+	for _, hit := range job.Limits {
+		taken.hits = append(taken.hits, takenHit{key: hit.Key, id: hit.ID})
+	}
+	return taken
+}
+
+// getRateLimit reads "otp-max-<name>", "otp-<name>-window" and "otp-<name>-lock-timeout" from conf,
+// a max of 0 turns the limit off. Negative values are rejected
+func getRateLimit(name string, defaultMax int) (rateLimit, error) {
+	limit := rateLimit{name: name}
+	var err error
+	if limit.max, err = utils.GetIntFromConf(fmt.Sprintf("otp-max-%s", name), defaultMax); err != nil {
+		return limit, err
+	}
+	if limit.window, err = utils.GetSecondsFromConf(fmt.Sprintf("otp-%s-window", name), time.Hour); err != nil {
+		return limit, err
+	}
+	if limit.lock, err = utils.GetSecondsFromConf(fmt.Sprintf("otp-%s-lock-timeout", name), 0); err != nil {
+		return limit, err
+	}
+	if limit.max < 0 || limit.window < 0 || limit.lock < 0 {
+		return limit, fmt.Errorf("otp-max-%s, otp-%s-window and otp-%s-lock-timeout can not be negative", name, name, name)
+	}
+	return limit, nil
+}
+
+// CheckLimits loads the rate limits from conf, so a bad limit fails at startup instead of every request
+func CheckLimits() error {
+	if _, err := getRateLimit(LIMIT_CODES, 5); err != nil {
+		return err
+	}
+	_, err := getRateLimit(LIMIT_SENDS, 10)
+	return err
+}
+
+// takeLimit counts one event against the limit of the identifier, adds it to taken and returns how many
+// are left, -1 when the limit is off. A refused event returns a *LimitError and locks the limit when
+// configured
+func takeLimit(ctx context.Context, identifier string, limit rateLimit, taken *takenLimits) (int, error) {
+	if limit.max <= 0 || limit.window <= 0 {
+		return -1, nil
+	}
+	lockKey := utils.GetLimitLockKey(identifier, limit.name)
+	lockTTL, err := getTTLData(ctx, lockKey)
+	if err != nil {
+		return -1, err
+	}
+	if lockTTL > 0 {
+		metrics.LimitRejections.WithLabelValues(limit.name, "true").Inc()
+		return 0, &LimitError{Limit: limit.name, RetryAfter: lockTTL, Locked: true}
+	}
+
+	key := utils.GetLimitKey(identifier, limit.name)
+	result, err := hitInCache(ctx, key, limit.max, limit.window)
+	if err != nil {
+		return -1, err
+	}
+	if result.Allowed {
+		taken.hits = append(taken.hits, takenHit{key: key, id: result.ID})
+		return result.Remaining, nil
+	}
+
+	utils.Log.Info(fmt.Sprintf("Limit of %d %s per %s reached", limit.max, limit.name, limit.window))
+	metrics.LimitRejections.WithLabelValues(limit.name, strconv.FormatBool(limit.lock > 0)).Inc()
+	if limit.lock > 0 {
+		if err := storeInCache(ctx, lockKey, true, limit.lock); err != nil {
+			return -1, err
+		}
+		return 0, &LimitError{Limit: limit.name, RetryAfter: limit.lock, Locked: true}
+	}
+	return 0, &LimitError{Limit: limit.name, RetryAfter: result.RetryAfter}
+}
+
+// TakeIssueLimits counts a new code against the code and the send limit of the identifier. Both are
+// checked before anything is sent, so a refused request costs the provider nothing, and a request
+// refused by either limit takes nothing from the other. Refund the returned limits when the code is
+// not sent after all
+func TakeIssueLimits(ctx context.Context, identifier string) (*Remaining, *takenLimits, error) {
+	codes, err := getRateLimit(LIMIT_CODES, 5)
+	if err != nil {
+		return nil, nil, err
+	}
+	sends, err := getRateLimit(LIMIT_SENDS, 10)
+	if err != nil {
+		return nil, nil, err
+	}
+	taken := &takenLimits{}
+	codesLeft, err := takeLimit(ctx, identifier, codes, taken)
+	if err != nil {
+		return nil, nil, err
+	}
+	sendsLeft, err := takeLimit(ctx, identifier, sends, taken)
+	if err != nil {
+		taken.refund(ctx)
+		return nil, nil, err
+	}
+	return &Remaining{Sends: limitLeft(sendsLeft), Codes: limitLeft(codesLeft)}, taken, nil
+}
+
+// takeSendLimit counts one delivery of a code against the send limit of the identifier, refund the
+// returned limit when the code is not sent after all
+func takeSendLimit(ctx context.Context, identifier string) (int, *takenLimits, error) {
+	sends, err := getRateLimit(LIMIT_SENDS, 10)
+	if err != nil {
+		return -1, nil, err
+	}
+	taken := &takenLimits{}
+	left, err := takeLimit(ctx, identifier, sends, taken)
+	return left, taken, err
+}
+
+// limitLeft leaves a limit that is off out of the response
+func limitLeft(left int) *int {
+	if left < 0 {
+		return nil
+	}
+	return &left
+}
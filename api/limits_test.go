@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/queue"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/store"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+var testIdentifier = utils.GetIdentifier(utils.PHONE, "+14155552671")
+
+func TestTakeLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     rateLimit
+		taken     int
+		want      int
+		wantErr   *LimitError
+		wantTaken int
+	}{
+		{"off", rateLimit{name: LIMIT_SENDS, max: 0, window: time.Hour}, 5, -1, nil, 0},
+		{"no window", rateLimit{name: LIMIT_SENDS, max: 3}, 5, -1, nil, 0},
+		{"first event", rateLimit{name: LIMIT_SENDS, max: 3, window: time.Hour}, 0, 2, nil, 1},
+		{"last event", rateLimit{name: LIMIT_SENDS, max: 3, window: time.Hour}, 2, 0, nil, 1},
+		{"refused", rateLimit{name: LIMIT_SENDS, max: 3, window: time.Hour}, 3, 0,
+			&LimitError{Limit: LIMIT_SENDS, RetryAfter: time.Hour}, 0},
+		{"refused and locked", rateLimit{name: LIMIT_CODES, max: 1, window: time.Hour, lock: 10 * time.Minute}, 1, 0,
+			&LimitError{Limit: LIMIT_CODES, RetryAfter: 10 * time.Minute, Locked: true}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			SetStore(store.NewMemoryStore())
+			for i := 0; i < tt.taken; i++ {
+				if _, err := takeLimit(ctx, testIdentifier, tt.limit, &takenLimits{}); err != nil {
+					t.Fatalf("takeLimit() error = %v", err)
+				}
+			}
+
+			taken := &takenLimits{}
+			got, err := takeLimit(ctx, testIdentifier, tt.limit, taken)
+			if got != tt.want {
+				t.Errorf("takeLimit() = %d, want %d", got, tt.want)
+			}
+			if len(taken.hits) != tt.wantTaken {
+				t.Errorf("takeLimit() took %d events, want %d", len(taken.hits), tt.wantTaken)
+			}
+			var limitErr *LimitError
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Errorf("takeLimit() error = %v, want nil", err)
+			case tt.wantErr != nil && !errors.As(err, &limitErr):
+				t.Errorf("takeLimit() error = %v, want a *LimitError", err)
+			case tt.wantErr != nil:
+				limitErr.RetryAfter = limitErr.RetryAfter.Round(time.Minute)
+				if *limitErr != *tt.wantErr {
+					t.Errorf("takeLimit() error = %+v, want %+v", *limitErr, *tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestTakeLimitWhileLocked(t *testing.T) {
+	ctx := context.Background()
+	SetStore(store.NewMemoryStore())
+	limit := rateLimit{name: LIMIT_SENDS, max: 1, window: time.Hour, lock: 10 * time.Minute}
+
+	taken := &takenLimits{}
+	takeLimit(ctx, testIdentifier, limit, taken)
+	takeLimit(ctx, testIdentifier, limit, &takenLimits{})
+	//a refund gives back the event, not the lock
+	taken.refund(ctx)
+
+	var limitErr *LimitError
+	if _, err := takeLimit(ctx, testIdentifier, limit, &takenLimits{}); !errors.As(err, &limitErr) || !limitErr.Locked {
+		t.Errorf("takeLimit() while locked error = %v, want a locked *LimitError", err)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	limit := rateLimit{name: LIMIT_SENDS, max: 2, window: time.Hour}
+
+	tests := []struct {
+		name    string
+		refund  func(ctx context.Context, taken *takenLimits)
+		wantErr bool
+	}{
+		{"refunded", func(ctx context.Context, taken *takenLimits) { taken.refund(ctx) }, false},
+		{"refunded twice", func(ctx context.Context, taken *takenLimits) {
+			taken.refund(ctx)
+			taken.refund(ctx)
+		}, false},
+		{"refunded on a canceled context", func(ctx context.Context, taken *takenLimits) {
+			ctx, cancel := context.WithCancel(ctx)
+			cancel()
+			taken.refund(ctx)
+		}, false},
+		{"through a queued job", func(ctx context.Context, taken *takenLimits) {
+			job := queue.Job{Limits: taken.queueHits()}
+			takenByJob(&job).refund(ctx)
+		}, false},
+		{"not refunded", func(ctx context.Context, taken *takenLimits) {}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			SetStore(store.NewMemoryStore())
+			taken := &takenLimits{}
+			for i := 0; i < limit.max; i++ {
+				if _, err := takeLimit(ctx, testIdentifier, limit, taken); err != nil {
+					t.Fatalf("takeLimit() error = %v", err)
+				}
+			}
+			tt.refund(ctx, taken)
+
+			left, err := takeLimit(ctx, testIdentifier, limit, &takenLimits{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("takeLimit() after refund error = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && left != limit.max-1 {
+				t.Errorf("takeLimit() after refund = %d, want %d", left, limit.max-1)
+			}
+		})
+	}
+}
+
+func TestRefundNil(t *testing.T) {
+	var taken *takenLimits
+	taken.refund(context.Background())
+	if hits := taken.queueHits(); hits != nil {
+		t.Errorf("queueHits() = %v, want nil", hits)
+	}
+}
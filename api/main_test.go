@@ -0,0 +1,20 @@
+package api
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"github.com/pi-prakhar/utils/loader"
+	loggerUtil "github.com/pi-prakhar/utils/logger"
+)
+
+func TestMain(m *testing.M) {
+	utils.Log = loggerUtil.New(loggerUtil.WARN, "test")
+	loader.Logger = loggerUtil.New(loggerUtil.WARN, "test")
+	//conf is read from config/config.json in the working directory, the one of the repository
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
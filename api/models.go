@@ -1,7 +1,195 @@
 package api
 
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/health"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+// OTPData identifies the user by exactly one of phone number or email
 type OTPData struct {
-	PhoneNumber string `json:"phoneNumber,omitempty" validate:"required"`
+	PhoneNumber string `json:"phoneNumber,omitempty" validate:"required_without=Email"`
+	Email       string `json:"email,omitempty" validate:"required_without=PhoneNumber,omitempty,email,max=254"`
+	Channel     string `json:"channel,omitempty" validate:"omitempty,oneof=sms voice whatsapp email"`
+	Language    string `json:"language,omitempty" validate:"omitempty,max=16"`
+}
+
+// VerificationRequest addresses the current code of a user by the verificationId send-otp returned, so
+// knowing a phone number or email is not enough to resend its code or read its delivery
+type VerificationRequest struct {
+	OTPData
+	VerificationID string `json:"verificationId" validate:"required,len=32,hexadecimal"`
+}
+
+// Identifier returns the namespaced identifier the keys of the user are built from
+func (d *OTPData) Identifier() string {
+	if d.Email != "" {
+		return utils.GetIdentifier(utils.EMAIL, strings.ToLower(strings.TrimSpace(d.Email)))
+	}
+	return utils.GetIdentifier(utils.PHONE, d.PhoneNumber)
+}
+
+// Destination is the address the code is delivered to
+func (d *OTPData) Destination() string {
+	if d.Email != "" {
+		return d.Email
+	}
+	return d.PhoneNumber
+}
+
+// DeliveryChannel returns the requested channel, email for an email address and sms for a phone number when unset
+func (d *OTPData) DeliveryChannel() string {
+	switch {
+	case d.Channel != "":
+		return d.Channel
+	case d.Email != "":
+		return sender.EMAIL
+	default:
+		return sender.SMS
+	}
+}
+
+// CheckIdentifier rejects requests with both identifiers or a channel that can not reach the identifier
+func (d *OTPData) CheckIdentifier() error {
+	if d.PhoneNumber != "" && d.Email != "" {
+		return errors.New("only one of phoneNumber and email can be set")
+	}
+	if (d.Email != "") != (d.DeliveryChannel() == sender.EMAIL) {
+		return errors.New("channel email can only be used with an email and the other channels only with a phoneNumber")
+	}
+	return nil
+}
+
+// Delivery is every attempt to deliver the current code of one identifier
+type Delivery struct {
+	VerificationID string            `json:"verificationId"`
+	Destination    string            `json:"destination"`
+	Language       string            `json:"language,omitempty"`
+	CallbackRef    string            `json:"callbackRef,omitempty"`
+	Attempts       []DeliveryAttempt `json:"attempts"`
+}
+
+// StatusCallbackRef is what the opaque ref in a status callback url stands for
+type StatusCallbackRef struct {
+	Identifier     string `json:"identifier"`
+	VerificationID string `json:"verificationId"`
+}
+
+// DeliveryAttempt is the code sent on one channel, Trigger is what caused the send. Status is the
+// furthest status twilio reported, Transitions every report in the order it arrived
+type DeliveryAttempt struct {
+	Channel     string             `json:"channel"`
+	Trigger     string             `json:"trigger"`
+	Provider    string             `json:"provider,omitempty"`
+	MessageID   string             `json:"messageId,omitempty"`
+	Status      string             `json:"status,omitempty"`
+	ErrorCode   string             `json:"errorCode,omitempty"`
+	SentAt      time.Time          `json:"sentAt"`
+	Transitions []StatusTransition `json:"transitions,omitempty"`
+}
+
+// StatusTransition is one message status reported by twilio for an attempt
+type StatusTransition struct {
+	Attempt   int       `json:"attempt"`
+	MessageID string    `json:"messageId,omitempty"`
+	Status    string    `json:"status"`
+	ErrorCode string    `json:"errorCode,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// Channels returns the channels tried so far, in order
+func (d *Delivery) Channels() []string {
+	channels := make([]string, 0, len(d.Attempts))
+	for _, attempt := range d.Attempts {
+		channels = append(channels, attempt.Channel)
+	}
+	return channels
+}
+
+// ClientAttempts returns the attempts without the provider message IDs, which are only kept for the
+// records. With Twilio Verify the message ID is the verification SID the code is checked against
+func (d *Delivery) ClientAttempts() []DeliveryAttempt {
+	attempts := make([]DeliveryAttempt, 0, len(d.Attempts))
+	for _, attempt := range d.Attempts {
+		attempt.MessageID = ""
+		transitions := make([]StatusTransition, 0, len(attempt.Transitions))
+		for _, transition := range attempt.Transitions {
+			transition.MessageID = ""
+			transitions = append(transitions, transition)
+		}
+		attempt.Transitions = transitions
+		attempts = append(attempts, attempt)
+	}
+	return attempts
+}
+
+type DeliveryStatus struct {
+	User          *OTPData          `json:"user"`
+	ChannelsTried []string          `json:"channelsTried"`
+	Attempts      []DeliveryAttempt `json:"attempts"`
+}
+
+// v2 verification statuses
+const (
+	STATUS_PENDING  = "pending"
+	STATUS_APPROVED = "approved"
+	STATUS_EXPIRED  = "expired"
+	STATUS_CANCELED = "canceled"
+	STATUS_LOCKED   = "locked"
+)
+
+// Verification is a v2 verification resource. Its ID is the verification ID of the delivery, so the
+// status endpoint and the status callbacks refer to the same verification
+type Verification struct {
+	ID         string    `json:"id"`
+	Status     string    `json:"status"`
+	To         string    `json:"to"`
+	Channel    string    `json:"channel"`
+	TrialsLeft int       `json:"trialsLeft,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	// LockTTL is the seconds left on the lock of a locked verification, LockLevel its level
+	LockTTL   int `json:"lockTtl,omitempty"`
+	LockLevel int `json:"lockLevel,omitempty"`
+	// Remaining is only set on the verification a request created
+	Remaining *Remaining `json:"remaining,omitempty"`
+}
+
+// verificationRecord is how a verification is cached, with the identifier its code is kept under
+type verificationRecord struct {
+	Verification
+	Identifier string `json:"identifier"`
+}
+
+// CheckData is the code submitted for a v2 verification
+type CheckData struct {
+	Code string `json:"code,omitempty" validate:"required"`
+}
+
+// ResendData is the outcome of a resend. NextResendAt is the earliest time the code can be resent,
+// unset once no resend is left
+type ResendData struct {
+	User           *OTPData   `json:"user,omitempty"`
+	VerificationID string     `json:"verificationId"`
+	Channel        string     `json:"channel,omitempty"`
+	ResendsLeft    int        `json:"resendsLeft"`
+	NextResendAt   *time.Time `json:"nextResendAt,omitempty"`
+	Remaining      *Remaining `json:"remaining,omitempty"`
+}
+
+// ResendChannel is the optional channel of a v2 resend
+type ResendChannel struct {
+	Channel string `json:"channel,omitempty" validate:"omitempty,oneof=sms voice whatsapp email"`
+}
+
+type VoiceToken struct {
+	Token    string `json:"token"`
+	Language string `json:"language,omitempty"`
 }
 
 type VerifyData struct {
@@ -12,8 +200,48 @@ type VerifyData struct {
 type TimeData struct {
 	User *OTPData `json:"user,omitempty" validate:"required"`
 	TTL  int      `json:"ttl,omitempty" validate:"required"`
+	// Level is how many times the user was locked within otp-lock-lookback, this lock included
+	Level int `json:"level,omitempty"`
+}
+
+// OTPLock is the lock a user gets after the last wrong guess on a code
+type OTPLock struct {
+	TTL   time.Duration
+	Level int
 }
+
+// Minutes is the time left on the lock rounded up, so a client retrying after it finds the lock gone
+func (l *OTPLock) Minutes() int {
+	return int(math.Ceil(l.TTL.Minutes()))
+}
+
 type TrialsLeft struct {
-	User   *OTPData `json:"user,omitempty" validate:"required"`
-	Trials int      `json:"trials,omitempty" validate:"required"`
+	User           *OTPData   `json:"user,omitempty" validate:"required"`
+	Trials         int        `json:"trials,omitempty" validate:"required"`
+	VerificationID string     `json:"verificationId,omitempty"`
+	Remaining      *Remaining `json:"remaining,omitempty"`
+}
+
+// Remaining is what is left of each limit of the user, limits that are turned off are left out
+type Remaining struct {
+	// Guesses are the wrong codes that can still be tried on the current code
+	Guesses *int `json:"guesses,omitempty"`
+	// Sends and Codes are left in their rolling windows
+	Sends *int `json:"sends,omitempty"`
+	Codes *int `json:"codes,omitempty"`
+}
+
+type PoolStats struct {
+	Hits       uint32 `json:"hits"`
+	Misses     uint32 `json:"misses"`
+	Timeouts   uint32 `json:"timeouts"`
+	TotalConns uint32 `json:"totalConns"`
+	IdleConns  uint32 `json:"idleConns"`
+	StaleConns uint32 `json:"staleConns"`
+}
+
+type HealthReport struct {
+	Status   string          `json:"status"`
+	Draining bool            `json:"draining,omitempty"`
+	Checks   []health.Result `json:"checks,omitempty"`
 }
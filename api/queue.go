@@ -0,0 +1,258 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/breaker"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/queue"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+// send modes
+const (
+	SYNC_SEND  = "sync"
+	ASYNC_SEND = "async"
+)
+
+// how long a worker waits for new jobs before checking for jobs to retry
+const workerBlock = time.Second
+
+// errStaleJob is a job whose code was verified, expired or replaced by a newer one before it was sent
+var errStaleJob = errors.New("job is no longer the current verification")
+
+var sendQueue *queue.StreamQueue
+
+// SetQueue makes send-otp cache the code and queue its delivery for the workers, nil sends synchronously
+func SetQueue(q *queue.StreamQueue) {
+	sendQueue = q
+}
+
+// EnqueueOTP creates and caches a new code like IssueOTP, but leaves the delivery to the workers.
+// Nothing is kept when the code can not be cached or the job can not be queued. The job carries the
+// limits taken for the code, they are refunded when it is dead-lettered
+func EnqueueOTP(ctx context.Context, data OTPData, taken *takenLimits) (*Delivery, int, error) {
+	identifier := data.Identifier()
+	channel := data.DeliveryChannel()
+	if !channelSupported(channel) {
+		return nil, -1, fmt.Errorf("%w : %s", sender.ErrUnsupportedChannel, channel)
+	}
+	delivery := &Delivery{
+		VerificationID: newVerificationID(),
+		Destination:    data.Destination(),
+		Language:       data.Language,
+	}
+
+	snapshot, err := takeSnapshot(ctx,
+		utils.GetOTPCodeKey(identifier),
+		utils.GetOTPTrialsLeftKey(identifier),
+		utils.GetDeliveryKey(identifier),
+	)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to snapshot OTP data in cache")
+		return nil, -1, err
+	}
+
+	OTPCode := utils.CreateOTPString(6)
+	otpTrials, err := cacheIssuedOTP(ctx, identifier, OTPCode)
+	if err == nil {
+		//the delivery without attempts marks the verification the job belongs to
+		err = saveDelivery(ctx, identifier, delivery)
+	}
+	if err == nil {
+		_, err = sendQueue.Enqueue(ctx, queue.Job{
+			VerificationID: delivery.VerificationID,
+			Identifier:     identifier,
+			Destination:    delivery.Destination,
+			Channel:        channel,
+			Language:       data.Language,
+			EnqueuedAt:     time.Now().UTC(),
+			Limits:         taken.queueHits(),
+		})
+	}
+	if err != nil {
+		utils.Log.Debug("Error : Failed to queue OTP message")
+		snapshot.restore(ctx, utils.GetOTPCodeKey(identifier), OTPCode)
+		return nil, -1, err
+	}
+	metrics.QueueJobs.WithLabelValues("enqueued").Inc()
+	utils.Log.Debug("Successfully queued OTP message")
+	return delivery, otpTrials, nil
+}
+
+// RunWorkers delivers queued jobs with n workers until ctx is done, then waits for the sends in flight.
+// consumer names the workers in the consumer group and must be unique per process
+func RunWorkers(ctx context.Context, consumer string, n int) error {
+	if err := sendQueue.CreateGroup(ctx); err != nil {
+		utils.Log.Debug("Error : Failed to create queue consumer group")
+		return err
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		name := fmt.Sprintf("%s-%d", consumer, i)
+		go func() {
+			defer wg.Done()
+			runWorker(ctx, name)
+		}()
+	}
+	utils.Log.Info(fmt.Sprintf("Started %d send workers as %s", n, consumer))
+	wg.Wait()
+	utils.Log.Info("Send workers stopped")
+	return nil
+}
+
+// runWorker moves scheduled jobs that are due to the stream, takes jobs due for a retry first, then
+// waits for new ones
+func runWorker(ctx context.Context, name string) {
+	for ctx.Err() == nil {
+		if _, err := sendQueue.PromoteDue(ctx, 10); err != nil && ctx.Err() == nil {
+			utils.Log.Warn(fmt.Sprintf("Worker %s failed to move scheduled jobs to the send queue : %s", name, err.Error()))
+		}
+		messages, err := sendQueue.Claim(ctx, name, 1)
+		if err == nil && len(messages) == 0 {
+			messages, err = sendQueue.Read(ctx, name, 1, workerBlock)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			utils.Log.Warn(fmt.Sprintf("Worker %s failed to read the send queue : %s", name, err.Error()))
+			select {
+			case <-ctx.Done():
+			case <-time.After(workerBlock):
+			}
+			continue
+		}
+		for _, message := range messages {
+			//a job that was picked up is finished even during shutdown, so it is not sent twice
+			processJob(context.WithoutCancel(ctx), message)
+		}
+	}
+}
+
+// processJob sends one job and acks it, leaves it pending for a retry after a transient error, and
+// dead-letters it once it can not be delivered. A dead-lettered code is deleted so it can not be verified
+func processJob(ctx context.Context, message queue.Message) {
+	ctx, cancel := context.WithTimeout(ctx, appTimeout)
+	defer cancel()
+	config := sendQueue.Config()
+
+	if message.Job == nil {
+		deadLetter(ctx, message, message.DecodeErr)
+		return
+	}
+	if message.Job.Trigger != "" {
+		//the code already went out once, FallBack tries the next channels itself and is not retried
+		job := message.Job
+		if err := FallBack(ctx, job.Identifier, job.VerificationID, job.Attempt, job.Trigger); err != nil {
+			utils.Log.Warn(fmt.Sprintf("Channel fallback after timeout failed : %s", err.Error()))
+		}
+		metrics.QueueJobs.WithLabelValues("fallback").Inc()
+		ackJob(ctx, message)
+		return
+	}
+	if message.Deliveries > config.MaxDeliveries {
+		deadLetter(ctx, message, fmt.Errorf("no worker finished the job in %d deliveries", config.MaxDeliveries))
+		discardQueuedCode(ctx, message.Job)
+		return
+	}
+
+	err := deliverJob(ctx, message.Job)
+	switch {
+	case err == nil:
+		metrics.QueueJobs.WithLabelValues("sent").Inc()
+		metrics.QueueWait.Observe(metrics.Since(message.Job.EnqueuedAt))
+		ackJob(ctx, message)
+	case errors.Is(err, errStaleJob):
+		utils.Log.Debug("Skipping stale send job")
+		metrics.QueueJobs.WithLabelValues("skipped").Inc()
+		ackJob(ctx, message)
+	case jobRetryable(err) && message.Deliveries < config.MaxDeliveries:
+		utils.Log.Info(fmt.Sprintf("Send job failed, retrying in %s : %s", config.RetryAfter, err.Error()))
+		metrics.QueueJobs.WithLabelValues("retried").Inc()
+	default:
+		deadLetter(ctx, message, err)
+		discardQueuedCode(ctx, message.Job)
+	}
+}
+
+// deliverJob sends the cached code of the job, unless it is stale or was already sent by a worker
+// that stopped before acking it
+func deliverJob(ctx context.Context, job *queue.Job) error {
+	delivery, err := GetDelivery(ctx, job.Identifier)
+	if err != nil {
+		return err
+	}
+	if delivery == nil || delivery.VerificationID != job.VerificationID || len(delivery.Attempts) > 0 {
+		return errStaleJob
+	}
+	code, err := GetCachedOTPCode(ctx, job.Identifier)
+	if err != nil {
+		return err
+	}
+	if code == "" {
+		return errStaleJob
+	}
+
+	res, err := sendCode(ctx, job.Identifier, delivery, code, job.Channel)
+	if err != nil {
+		return err
+	}
+	if err := recordAttempt(ctx, job.Identifier, delivery, job.Channel, TRIGGER_REQUEST, res); err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to record delivery attempt : %s", err.Error()))
+	}
+	return nil
+}
+
+// jobRetryable reports whether a failed job is worth another try: transient provider errors and an open
+// circuit breaker. A timed out send may have reached the user, it is not sent again
+func jobRetryable(err error) bool {
+	if _, open := breaker.RetryAfter(err); open {
+		return true
+	}
+	return sender.IsRetryable(err)
+}
+
+func ackJob(ctx context.Context, message queue.Message) {
+	if err := sendQueue.Ack(ctx, message.ID); err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to ack send job %s : %s", message.ID, err.Error()))
+	}
+}
+
+// deadLetter records a job that can not be delivered as a dead letter, then acks it. The two steps are
+// not atomic, a job may be dead-lettered twice but is never lost
+func deadLetter(ctx context.Context, message queue.Message, reason error) {
+	utils.Log.Warn(fmt.Sprintf("Dead-lettering send job %s after %d deliveries : %s", message.ID, message.Deliveries, reason.Error()))
+	metrics.QueueJobs.WithLabelValues("dead_lettered").Inc()
+	if err := recordDeadJob(ctx, message, reason); err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to dead-letter send job %s : %s", message.ID, err.Error()))
+		return
+	}
+	ackJob(ctx, message)
+}
+
+// discardQueuedCode deletes the code of a job that will not be delivered, when it is still the current one,
+// and refunds the limits the job was counted as unless its code went out after all
+func discardQueuedCode(ctx context.Context, job *queue.Job) {
+	delivery, err := GetDelivery(ctx, job.Identifier)
+	if err != nil {
+		return
+	}
+	current := delivery != nil && delivery.VerificationID == job.VerificationID
+	if current && len(delivery.Attempts) > 0 {
+		return
+	}
+	takenByJob(job).refund(ctx)
+	if !current {
+		return
+	}
+	if err := deleteDataFromCache(ctx, utils.GetOTPCodeKey(job.Identifier)); err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to delete undelivered OTP code : %s", err.Error()))
+	}
+}
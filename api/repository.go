@@ -1,18 +1,52 @@
 package api
 
 import (
+	"context"
+	"fmt"
 	"time"
 
-	"github.com/go-redis/redis/v8"
-	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/database"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/store"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/tracing"
 	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func storeInCache(key string, value any, expiry time.Duration) error {
-	rdb := database.Client(0)
-	ctx := database.Ctx
+var otpStore store.OTPStore
 
-	err := rdb.Set(ctx, key, value, expiry).Err()
+// SetStore sets the store holding OTP state, it must be called before serving requests
+func SetStore(s store.OTPStore) {
+	otpStore = s
+}
+
+// cacheValue formats values the way redis does, bools are stored as 1 and 0
+func cacheValue(value any) string {
+	if b, ok := value.(bool); ok {
+		if b {
+			return "1"
+		}
+		return "0"
+	}
+	return fmt.Sprint(value)
+}
+
+// startStoreOp starts the span of one store operation, finish it with endStoreOp
+func startStoreOp(ctx context.Context, operation string) (context.Context, trace.Span, time.Time) {
+	ctx, span := tracing.Start(ctx, fmt.Sprintf("store.%s", operation), attribute.String("db.operation", operation))
+	return ctx, span, time.Now()
+}
+
+// endStoreOp records the latency of one store operation and ends its span
+func endStoreOp(span trace.Span, operation string, start time.Time, err error) {
+	metrics.StoreLatency.WithLabelValues(operation, metrics.Outcome(err)).Observe(metrics.Since(start))
+	tracing.End(span, err)
+}
+
+func storeInCache(ctx context.Context, key string, value any, expiry time.Duration) error {
+	ctx, span, start := startStoreOp(ctx, "set")
+	err := otpStore.Set(ctx, key, cacheValue(value), expiry)
+	endStoreOp(span, "set", start, err)
 	if err != nil {
 		utils.Log.Debug("Error : Failed to store data in cache")
 		return err
@@ -21,11 +55,10 @@ func storeInCache(key string, value any, expiry time.Duration) error {
 	return nil
 }
 
-func storeInCacheNoExpiry(key string, value any) error {
-	rdb := database.Client(0)
-	ctx := database.Ctx
-
-	err := rdb.Set(ctx, key, value, 0).Err()
+func storeInCacheNoExpiry(ctx context.Context, key string, value any) error {
+	ctx, span, start := startStoreOp(ctx, "set")
+	err := otpStore.Set(ctx, key, cacheValue(value), 0)
+	endStoreOp(span, "set", start, err)
 	if err != nil {
 		utils.Log.Debug("Error : Failed to store data with no expiry in cache")
 		return err
@@ -34,34 +67,47 @@ func storeInCacheNoExpiry(key string, value any) error {
 	return nil
 }
 
-func getCachedData(key string) (any, error) {
-	rdb := database.Client(0)
-	ctx := database.Ctx
-	cachedData, err := rdb.Get(ctx, key).Result()
-	if err == redis.Nil {
-		utils.Log.Debug("Data not present in cache")
-		return nil, nil
-	} else if err != nil {
+// storeInCacheIfAbsent stores value only when key is missing, returns false when it was already set
+func storeInCacheIfAbsent(ctx context.Context, key string, value any, expiry time.Duration) (bool, error) {
+	ctx, span, start := startStoreOp(ctx, "setnx")
+	stored, err := otpStore.SetNX(ctx, key, cacheValue(value), expiry)
+	endStoreOp(span, "setnx", start, err)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to store data if absent in cache")
+		return false, err
+	}
+	utils.Log.Debug(fmt.Sprintf("Successfully ran set if absent in cache, stored : %t", stored))
+	return stored, nil
+}
+
+func getCachedData(ctx context.Context, key string) (any, error) {
+	ctx, span, start := startStoreOp(ctx, "get")
+	cachedData, found, err := otpStore.Get(ctx, key)
+	endStoreOp(span, "get", start, err)
+	if err != nil {
 		utils.Log.Debug("Error : Failed to fetch data from cache")
 		return nil, err
+	} else if !found {
+		utils.Log.Debug("Data not present in cache")
+		return nil, nil
 	} else {
 		utils.Log.Debug("Successfully fetched data from cache")
 		return cachedData, nil
 	}
 }
 
-func getTTLData(key string) (time.Duration, error) {
-	rdb := database.Client(0)
-	ctx := database.Ctx
-	ttl, err := rdb.TTL(ctx, key).Result()
+func getTTLData(ctx context.Context, key string) (time.Duration, error) {
+	ctx, span, start := startStoreOp(ctx, "ttl")
+	ttl, err := otpStore.TTL(ctx, key)
+	endStoreOp(span, "ttl", start, err)
 	if err != nil {
 		utils.Log.Debug("Error : Failed to fetch ttl from cache")
 		return ttl, err
 	}
-	if ttl.Seconds() == -1 {
+	if ttl == store.NoExpiry {
 		utils.Log.Debug("Key does not expire")
 		return ttl, nil
-	} else if ttl.Seconds() == -2 {
+	} else if ttl == store.KeyMissing {
 		utils.Log.Debug("Error : Key does not exists")
 		return ttl, nil
 	}
@@ -69,14 +115,10 @@ func getTTLData(key string) (time.Duration, error) {
 	return ttl, nil
 }
 
-func deleteDataFromCache(key string) error {
-	rdb := database.Client(0)
-	ctx := database.Ctx
-	err := rdb.Del(ctx, key).Err()
-	if err == redis.Nil {
-		utils.Log.Debug("key not present in cache")
-		return nil
-	}
+func deleteDataFromCache(ctx context.Context, key string) error {
+	ctx, span, start := startStoreOp(ctx, "delete")
+	err := otpStore.Delete(ctx, key)
+	endStoreOp(span, "delete", start, err)
 	if err != nil {
 		utils.Log.Debug("Error : Failed deleting data from cache")
 		return err
@@ -85,15 +127,132 @@ func deleteDataFromCache(key string) error {
 	return nil
 }
 
-func decrementValueInCache(key string) error {
-	rdb := database.Client(0)
-	ctx := database.Ctx
-	err := rdb.Decr(ctx, key).Err()
+func pushToCache(ctx context.Context, key string, value string, expiry time.Duration) error {
+	ctx, span, start := startStoreOp(ctx, "push")
+	err := otpStore.Push(ctx, key, value, expiry)
+	endStoreOp(span, "push", start, err)
 	if err != nil {
-		utils.Log.Debug("Error : Failed to decrement data in cache")
+		utils.Log.Debug("Error : Failed to push data to list in cache")
 		return err
-	} else {
-		utils.Log.Info("Successfully decremented data in cache")
-		return nil
 	}
+	utils.Log.Debug("Successfully pushed data to list in cache")
+	return nil
+}
+
+func getCachedList(ctx context.Context, key string) ([]string, error) {
+	ctx, span, start := startStoreOp(ctx, "list")
+	values, err := otpStore.List(ctx, key)
+	endStoreOp(span, "list", start, err)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to fetch list from cache")
+		return nil, err
+	}
+	utils.Log.Debug("Successfully fetched list from cache")
+	return values, nil
+}
+
+func verifyInCache(ctx context.Context, keys store.VerifyKeys, code string, policy store.LockPolicy) (store.VerifyResult, error) {
+	ctx, span, start := startStoreOp(ctx, "verify")
+	result, err := otpStore.VerifyCode(ctx, keys, code, policy)
+	endStoreOp(span, "verify", start, err)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to verify code in cache")
+		return result, err
+	}
+	utils.Log.Debug(fmt.Sprintf("Successfully verified code in cache, outcome : %s", result.Outcome))
+	return result, nil
+}
+
+func hitInCache(ctx context.Context, key string, limit int, window time.Duration) (store.HitResult, error) {
+	ctx, span, start := startStoreOp(ctx, "hit")
+	result, err := otpStore.Hit(ctx, key, limit, window)
+	endStoreOp(span, "hit", start, err)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to count event in cache")
+		return result, err
+	}
+	utils.Log.Debug(fmt.Sprintf("Successfully counted event in cache, allowed : %t", result.Allowed))
+	return result, nil
+}
+
+func recordLockInCache(ctx context.Context, key string, lookback time.Duration) (int, error) {
+	ctx, span, start := startStoreOp(ctx, "record_lock")
+	level, err := otpStore.RecordLock(ctx, key, lookback)
+	endStoreOp(span, "record_lock", start, err)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to record lock in cache")
+		return 0, err
+	}
+	utils.Log.Debug(fmt.Sprintf("Successfully recorded lock in cache, level : %d", level))
+	return level, nil
+}
+
+func unhitInCache(ctx context.Context, key string, id string) error {
+	ctx, span, start := startStoreOp(ctx, "unhit")
+	err := otpStore.Unhit(ctx, key, id)
+	endStoreOp(span, "unhit", start, err)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to remove event from cache")
+		return err
+	}
+	utils.Log.Debug("Successfully removed event from cache")
+	return nil
+}
+
+func restoreInCache(ctx context.Context, key string, current string, snapshots []store.Snapshot) (bool, error) {
+	ctx, span, start := startStoreOp(ctx, "restore")
+	restored, err := otpStore.Restore(ctx, key, current, snapshots)
+	endStoreOp(span, "restore", start, err)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to restore data in cache")
+		return false, err
+	}
+	utils.Log.Debug(fmt.Sprintf("Successfully ran restore in cache, restored : %t", restored))
+	return restored, nil
+}
+
+// cacheSnapshot is the value and time left of some keys before a change, so the change can be undone
+type cacheSnapshot struct {
+	entries []store.Snapshot
+}
+
+// takeSnapshot records the current state of keys
+func takeSnapshot(ctx context.Context, keys ...string) (*cacheSnapshot, error) {
+	snapshot := &cacheSnapshot{}
+	for _, key := range keys {
+		entry := store.Snapshot{Key: key}
+		value, err := getCachedData(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			ttl, err := getTTLData(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			entry.Value, entry.Found, entry.TTL = value.(string), ttl != store.KeyMissing, ttl
+		}
+		snapshot.entries = append(snapshot.entries, entry)
+	}
+	return snapshot, nil
+}
+
+// restore puts every key back the way it was, keys that did not exist are deleted and values keep the
+// time they had left. Nothing is restored once key no longer holds current, the value this change set:
+// a newer code issued meanwhile is kept. It runs even when ctx is done, so a canceled request still
+// leaves no trace
+func (s *cacheSnapshot) restore(ctx context.Context, key string, current string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second*5)
+	defer cancel()
+
+	restored, err := restoreInCache(ctx, key, current, s.entries)
+	if err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to roll back cache : %s", err.Error()))
+		return
+	}
+	if !restored {
+		utils.Log.Info("Cache changed since, not rolling it back")
+		return
+	}
+	utils.Log.Debug("Successfully rolled back cache")
 }
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+// resend outcomes
+const (
+	RESEND_SENT     = "sent"
+	RESEND_NO_CODE  = "no_code"
+	RESEND_TOO_SOON = "too_soon"
+	RESEND_LIMIT    = "limit"
+)
+
+// resendConfig is the cooldown between two sends of a code and the cap on resends per verification
+type resendConfig struct {
+	interval time.Duration
+	max      int
+}
+
+func getResendConfig() (resendConfig, error) {
+	var cfg resendConfig
+	var err error
+	if cfg.interval, err = utils.GetSecondsFromConf("otp-resend-interval", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.max, err = utils.GetIntFromConf("otp-max-resends", 3); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// ResendOTPCode re-delivers the still valid code of the identifier on channel, or on the channel of the last
+// attempt when channel is empty. The code and its expiry are kept. A resend is refused until the resend
+// interval passed since the last attempt and once the verification used up its resends, a failed send
+// does not count as a resend. Every resend counts against the send limit of the identifier. Only the
+// current verification of the identifier is resent, verificationID must match it
+func ResendOTPCode(ctx context.Context, identifier string, verificationID string, channel string) (string, *ResendData, error) {
+	outcome, data, err := resendOTPCode(ctx, identifier, verificationID, channel)
+	if err != nil {
+		outcome = "error"
+	}
+	if data != nil && data.Channel != "" {
+		channel = data.Channel
+	}
+	metrics.Resends.WithLabelValues(channel, outcome).Inc()
+	return outcome, data, err
+}
+
+func resendOTPCode(ctx context.Context, identifier string, verificationID string, channel string) (string, *ResendData, error) {
+	cfg, err := getResendConfig()
+	if err != nil {
+		return "", nil, err
+	}
+	delivery, err := GetDelivery(ctx, identifier)
+	if err != nil {
+		return "", nil, err
+	}
+	if delivery == nil || delivery.VerificationID != verificationID {
+		utils.Log.Debug("Resend skipped, no current verification")
+		return RESEND_NO_CODE, nil, nil
+	}
+	code, err := GetCachedOTPCode(ctx, identifier)
+	if err != nil {
+		return "", nil, err
+	}
+	if code == "" {
+		utils.Log.Debug("Resend skipped, code verified or expired")
+		return RESEND_NO_CODE, nil, nil
+	}
+
+	resends := 0
+	for _, attempt := range delivery.Attempts {
+		if attempt.Trigger == TRIGGER_RESEND {
+			resends++
+		}
+	}
+	data := &ResendData{
+		VerificationID: delivery.VerificationID,
+		ResendsLeft:    max(0, cfg.max-resends),
+	}
+	if data.ResendsLeft == 0 {
+		return RESEND_LIMIT, data, nil
+	}
+
+	//a queued code the send workers did not deliver yet counts as just sent
+	now := time.Now().UTC()
+	if len(delivery.Attempts) == 0 {
+		next := now.Add(cfg.interval)
+		data.NextResendAt = &next
+		return RESEND_TOO_SOON, data, nil
+	}
+	last := delivery.Attempts[len(delivery.Attempts)-1]
+	if next := last.SentAt.Add(cfg.interval); now.Before(next) {
+		data.NextResendAt = &next
+		return RESEND_TOO_SOON, data, nil
+	}
+	if channel == "" {
+		channel = last.Channel
+	}
+	if !channelSupported(channel) {
+		return "", nil, fmt.Errorf("%w : %s", sender.ErrUnsupportedChannel, channel)
+	}
+
+	//concurrent resends all pass the check above, the guard key lets one of them send per interval
+	key := utils.GetResendKey(identifier, delivery.VerificationID)
+	first, err := storeInCacheIfAbsent(ctx, key, true, max(cfg.interval, time.Second))
+	if err != nil {
+		return "", nil, err
+	}
+	if !first {
+		ttl, err := getTTLData(ctx, key)
+		if err != nil {
+			return "", nil, err
+		}
+		next := now.Add(max(0, ttl))
+		data.NextResendAt = &next
+		return RESEND_TOO_SOON, data, nil
+	}
+
+	releaseCooldown := func() {
+		if err := deleteDataFromCache(ctx, key); err != nil {
+			utils.Log.Warn(fmt.Sprintf("Failed to release resend cooldown : %s", err.Error()))
+		}
+	}
+	sendsLeft, taken, err := takeSendLimit(ctx, identifier)
+	if err != nil {
+		releaseCooldown()
+		return "", nil, err
+	}
+
+	var res sender.Result
+	if verifyService != nil {
+		//twilio verify resends the code of the pending verification
+		res, err = startVerification(ctx, delivery.Destination, channel)
+		if err == nil {
+			updateVerificationSid(ctx, identifier, code, res.MessageID)
+		}
+	} else {
+		res, err = sendCode(ctx, identifier, delivery, code, channel)
+	}
+	if err != nil {
+		utils.Log.Info(fmt.Sprintf("Resend on %s failed", channel))
+		releaseCooldown()
+		taken.refund(ctx)
+		recordFailedSend(ctx, delivery.Destination, channel, delivery.Language, err)
+		return "", nil, err
+	}
+	if err := recordAttempt(ctx, identifier, delivery, channel, TRIGGER_RESEND, res); err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to record delivery attempt : %s", err.Error()))
+	}
+
+	data.Channel = channel
+	data.ResendsLeft--
+	data.Remaining = &Remaining{Sends: limitLeft(sendsLeft)}
+	if data.ResendsLeft > 0 {
+		next := now.Add(cfg.interval)
+		data.NextResendAt = &next
+	}
+	return RESEND_SENT, data, nil
+}
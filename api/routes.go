@@ -4,7 +4,10 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
 	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/response"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/tracing"
 	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
 )
 
@@ -24,6 +27,27 @@ func New() *mux.Router {
 	})
 	r.HandleFunc("/api/send-otp", SendOTP)
 	r.HandleFunc("/api/verify-otp", VerifyOTP)
+	r.HandleFunc("/api/resend-otp", ResendOTP).Methods(http.MethodPost)
+	r.HandleFunc("/api/otp-status", OTPStatus).Methods(http.MethodPost)
+	r.HandleFunc("/v2/verifications", NewVerification).Methods(http.MethodPost)
+	r.HandleFunc("/v2/verifications/{id:[0-9a-f]{32}}", VerificationStatus).Methods(http.MethodGet)
+	r.HandleFunc("/v2/verifications/{id:[0-9a-f]{32}}/check", VerificationCheck).Methods(http.MethodPost)
+	r.HandleFunc("/v2/verifications/{id:[0-9a-f]{32}}/resend", VerificationResend).Methods(http.MethodPost)
+	r.HandleFunc("/v2/verifications/{id:[0-9a-f]{32}}/cancel", VerificationCancel).Methods(http.MethodPost)
+	r.HandleFunc(sender.VOICE_TWIML_PATH, VoiceTwiML).Methods(http.MethodGet, http.MethodPost)
+	r.HandleFunc(STATUS_CALLBACK_PATH, MessageStatus).Methods(http.MethodPost)
+	r.HandleFunc("/healthz", Liveness).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", Readiness).Methods(http.MethodGet)
 
+	r.Use(tracing.Middleware, metrics.Middleware)
+
+	return r
+}
+
+// NewAdmin returns the router of the internal endpoints, served on "admin-addr" away from the public api
+func NewAdmin() *mux.Router {
+	r := mux.NewRouter()
+	r.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
+	r.HandleFunc("/debug/redis/pool-stats", RedisPoolStats).Methods(http.MethodGet)
 	return r
 }
@@ -1,41 +1,266 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"strconv"
+	"time"
 
-	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/config"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/store"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/tracing"
 	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
-	twilioApi "github.com/twilio/twilio-go/rest/api/v2010"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func SendOTPMessage(phoneNumber string, OTPCode string) (string, error) {
-	twilioClient := config.GetTwilioClient()
-	twilioPhoneNumber := config.GetTwilioPhoneNumber()
-	messageString := fmt.Sprintf("OTP message is %s", OTPCode)
-	params := &twilioApi.CreateMessageParams{}
-	params.SetTo(phoneNumber)
-	params.SetFrom(twilioPhoneNumber)
-	params.SetBody(messageString)
+var otpSender sender.Sender
 
-	res, err := twilioClient.Api.CreateMessage(params)
+// SetSender sets the sender used to deliver OTP codes, it must be called before serving requests
+func SetSender(s sender.Sender) {
+	otpSender = s
+}
+
+func SendOTPMessage(ctx context.Context, message sender.Message) (sender.Result, error) {
+	ctx, span := tracing.Start(ctx, "otp.send_message", attribute.String("otp.channel", message.Channel))
+	res, err := otpSender.Send(ctx, message)
+	metrics.Sends.WithLabelValues(metrics.Outcome(err)).Inc()
+	span.SetAttributes(attribute.String("otp.message_id", res.MessageID), attribute.String("otp.message_status", res.Status))
+	tracing.End(span, err)
 	if err != nil {
 		utils.Log.Debug("Error : Failed to send OTP message to user")
+		return sender.Result{}, failedSend{err}
+	}
+	utils.Log.Debug(fmt.Sprintf("Successfully send OTP message to user, id : %s, status : %s", res.MessageID, res.Status))
+
+	return res, nil
+}
+
+const (
+	LOCAL_BACKEND         = "local"
+	TWILIO_VERIFY_BACKEND = "twilio-verify"
+)
+
+var verifyService *sender.VerifyService
+
+// SetVerifyService makes send and verify delegate the code to Twilio Verify, nil keeps self managed codes
+func SetVerifyService(s *sender.VerifyService) {
+	verifyService = s
+}
+
+// IssueOTP creates, caches and delivers a new code and returns the delivery with the trials left.
+// With Twilio Verify the verification SID is cached in place of the code, so expiry, trials and locks
+// work the same way in both modes. Issuing is all or nothing: when the provider rejects the message or
+// the cache can not be updated, the code, trials and voice token are restored to what they were and a
+// started twilio verification is canceled. A send that timed out may have been delivered, its code is
+// kept. Every delivery attempt is recorded against a new verification ID for the status endpoint
+func IssueOTP(ctx context.Context, data OTPData) (*Delivery, int, error) {
+	identifier := data.Identifier()
+	channel := data.DeliveryChannel()
+	delivery := &Delivery{
+		VerificationID: newVerificationID(),
+		Destination:    data.Destination(),
+		Language:       data.Language,
+	}
+
+	snapshot, err := takeSnapshot(ctx,
+		utils.GetOTPCodeKey(identifier),
+		utils.GetOTPTrialsLeftKey(identifier),
+		utils.GetVoiceTokenKey(identifier),
+	)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to snapshot OTP data in cache")
+		return nil, -1, err
+	}
+
+	var res sender.Result
+	var otpTrials int
+	if verifyService != nil {
+		//twilio generates the code, so the verification is started first and canceled on failure
+		res, err = startVerification(ctx, delivery.Destination, channel)
+		if err != nil {
+			recordFailedSend(ctx, delivery.Destination, channel, delivery.Language, err)
+			return nil, -1, err
+		}
+		otpTrials, err = cacheIssuedOTP(ctx, identifier, res.MessageID)
+		if err != nil {
+			snapshot.restore(ctx, utils.GetOTPCodeKey(identifier), res.MessageID)
+			cancelVerification(ctx, res.MessageID)
+			return nil, -1, err
+		}
+		utils.Log.Debug("Successfully started twilio verification")
+	} else {
+		OTPCode := utils.CreateOTPString(6)
+		utils.Log.Debug("Successfully created OTP Code")
+
+		otpTrials, err = cacheIssuedOTP(ctx, identifier, OTPCode)
+		if err != nil {
+			snapshot.restore(ctx, utils.GetOTPCodeKey(identifier), OTPCode)
+			return nil, -1, err
+		}
+		res, err = sendCode(ctx, identifier, delivery, OTPCode, channel)
+		if err != nil && sendOutcomeUnknown(err) {
+			//the code may have reached the user, it stays valid
+			utils.Log.Info("Delivery outcome unknown, keeping OTP code")
+			recordFailedSend(ctx, delivery.Destination, channel, delivery.Language, err)
+			return nil, -1, err
+		}
+		if err != nil {
+			utils.Log.Info("Delivery failed, rolling back OTP code")
+			snapshot.restore(ctx, utils.GetOTPCodeKey(identifier), OTPCode)
+			recordFailedSend(ctx, delivery.Destination, channel, delivery.Language, err)
+			return nil, -1, err
+		}
+	}
+
+	//the code is out, a failure to record the attempt only costs the status and the fallback
+	if err := recordAttempt(ctx, identifier, delivery, channel, TRIGGER_REQUEST, res); err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to record delivery attempt : %s", err.Error()))
+	}
+	return delivery, otpTrials, nil
+}
+
+// sendOutcomeUnknown reports whether a failed send may still have reached the provider: the request ran
+// out of time, or the connection timed out after the request was written
+func sendOutcomeUnknown(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout() && !sender.IsRetryable(err))
+}
+
+// cacheIssuedOTP stores the code with a full set of trials, wrong guesses are limited per code, it
+// returns the trials left
+func cacheIssuedOTP(ctx context.Context, identifier string, OTPCode string) (int, error) {
+	if err := SetOTPInCache(ctx, identifier, OTPCode); err != nil {
+		utils.Log.Debug("Error : Failed to store OTP in cache")
+		return -1, err
+	}
+	return SetMaxOTPTrials(ctx, identifier)
+}
+
+// updateVerificationSid caches the verification SID twilio returned for a resend or another channel in
+// place of the one checked so far, keeping the time and trials left of the code. The code is out
+// already, so a failure is only logged
+func updateVerificationSid(ctx context.Context, identifier string, cachedSid string, verificationSid string) {
+	if verificationSid == "" || verificationSid == cachedSid {
+		return
+	}
+	key := utils.GetOTPCodeKey(identifier)
+	ttl, err := getTTLData(ctx, key)
+	if err == nil && ttl <= 0 {
+		//the code expired meanwhile
+		return
+	}
+	if err == nil {
+		err = storeInCache(ctx, key, verificationSid, ttl)
+	}
+	if err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to replace verification SID in cache : %s", err.Error()))
+		return
+	}
+	utils.Log.Debug("Successfully replaced verification SID in cache")
+}
+
+// cancelVerification cancels a twilio verification that could not be cached, so its code can not be used
+func cancelVerification(ctx context.Context, verificationSid string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second*5)
+	defer cancel()
+	if err := verifyService.Cancel(ctx, verificationSid); err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to cancel twilio verification : %s", err.Error()))
+	}
+}
+
+// startVerification starts, or resends on another channel, the twilio verification of destination
+func startVerification(ctx context.Context, destination string, channel string) (sender.Result, error) {
+	//twilio verify names the voice channel "call"
+	verifyChannel := channel
+	if channel == sender.VOICE {
+		verifyChannel = "call"
+	}
+	res, err := verifyService.Start(ctx, destination, verifyChannel)
+	metrics.Sends.WithLabelValues(metrics.Outcome(err)).Inc()
+	if err != nil {
+		utils.Log.Debug("Error : Failed to start twilio verification")
+		return sender.Result{}, failedSend{err}
+	}
+	return res, nil
+}
+
+// sendCode delivers an already cached code on channel as the next attempt of delivery
+func sendCode(ctx context.Context, identifier string, delivery *Delivery, OTPCode string, channel string) (sender.Result, error) {
+	statusCallback, err := statusCallbackURL(ctx, identifier, delivery, channel)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to build status callback url")
+		return sender.Result{}, err
+	}
+	message := sender.Message{
+		To:             delivery.Destination,
+		Code:           OTPCode,
+		Channel:        channel,
+		Language:       delivery.Language,
+		StatusCallback: statusCallback,
+	}
+	if channel == sender.VOICE {
+		token, err := SetVoiceToken(ctx, identifier, delivery.Language)
+		if err != nil {
+			utils.Log.Debug("Error : Failed to store voice token in cache")
+			return sender.Result{}, err
+		}
+		message.Token = token
+	}
+	return SendOTPMessage(ctx, message)
+}
+
+// SetVoiceToken stores the secret twilio presents when fetching the call script, valid as long as the code
+func SetVoiceToken(ctx context.Context, identifier string, language string) (string, error) {
+	key := utils.GetVoiceTokenKey(identifier)
+	otpTimeout, err := utils.GetOTPTimeout()
+	if err != nil {
+		utils.Log.Debug("Error : Failed to fetch OTP timeout from conf")
+		return "", err
+	}
+	token := utils.CreateOTPString(24)
+	value, err := json.Marshal(VoiceToken{Token: token, Language: language})
+	if err != nil {
 		return "", err
 	}
-	utils.Log.Debug("Successfully send OTP message to user")
+	if err := storeInCache(ctx, key, string(value), otpTimeout); err != nil {
+		utils.Log.Debug("Error : Failed to store voice token in cache")
+		return "", err
+	}
+	utils.Log.Debug("Successfully stored voice token in cache")
+	return token, nil
+}
 
-	return *res.Sid, nil
+// GetVoiceToken returns the voice token of the identifier, nil when it expired
+func GetVoiceToken(ctx context.Context, identifier string) (*VoiceToken, error) {
+	key := utils.GetVoiceTokenKey(identifier)
+	cached, err := getCachedData(ctx, key)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to fetch voice token from cache")
+		return nil, err
+	}
+	if cached == nil {
+		utils.Log.Debug("Voice token not present in cache")
+		return nil, nil
+	}
+	var token VoiceToken
+	if err := json.Unmarshal([]byte(cached.(string)), &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
 }
 
-func SetOTPInCache(phoneNumber string, OTPCode string) error {
-	key := utils.GetOTPCodeKey(phoneNumber)
+func SetOTPInCache(ctx context.Context, identifier string, OTPCode string) error {
+	key := utils.GetOTPCodeKey(identifier)
 	otpTimeout, err := utils.GetOTPTimeout()
 	if err != nil {
 		utils.Log.Debug("Error : Failed to fetch OTP timeout from conf")
 		return err
 	}
-	err = storeInCache(key, OTPCode, otpTimeout)
+	err = storeInCache(ctx, key, OTPCode, otpTimeout)
 	if err != nil {
 		utils.Log.Debug("Error : Failed to store OTP code in cache")
 		return err
@@ -44,9 +269,9 @@ func SetOTPInCache(phoneNumber string, OTPCode string) error {
 	return nil
 }
 
-func GetOTPTrialsLeft(phoneNumber string) (int, error) {
-	key := utils.GetOTPTrialsLeftKey(phoneNumber)
-	otpTrialsLeft, err := getCachedData(key)
+func GetOTPTrialsLeft(ctx context.Context, identifier string) (int, error) {
+	key := utils.GetOTPTrialsLeftKey(identifier)
+	otpTrialsLeft, err := getCachedData(ctx, key)
 
 	if err != nil {
 		utils.Log.Debug("Error : Failed to fetch OTP trials left from cache")
@@ -63,14 +288,20 @@ func GetOTPTrialsLeft(phoneNumber string) (int, error) {
 	return otpTrialsLeftInt, nil
 }
 
-func SetMaxOTPTrials(phoneNumber string) (int, error) {
-	key := utils.GetOTPTrialsLeftKey(phoneNumber)
+// SetMaxOTPTrials sets the trials left to max, they expire with the code they belong to
+func SetMaxOTPTrials(ctx context.Context, identifier string) (int, error) {
+	key := utils.GetOTPTrialsLeftKey(identifier)
 	otpMaxTrials, err := utils.GetOTPMaxTrials()
 	if err != nil {
 		utils.Log.Debug("Error : Failed to load otp-max-trials from conf")
 		return -1, err
 	}
-	err = storeInCacheNoExpiry(key, otpMaxTrials)
+	otpTimeout, err := utils.GetOTPTimeout()
+	if err != nil {
+		utils.Log.Debug("Error : Failed to fetch OTP timeout from conf")
+		return -1, err
+	}
+	err = storeInCache(ctx, key, otpMaxTrials, otpTimeout)
 	if err != nil {
 		utils.Log.Debug("Error : Failed to set OTP trials left to max in cache")
 		return -1, err
@@ -80,9 +311,9 @@ func SetMaxOTPTrials(phoneNumber string) (int, error) {
 	return otpMaxTrials, nil
 }
 
-func GetCachedOTPCode(phoneNumber string) (string, error) {
-	key := utils.GetOTPCodeKey(phoneNumber)
-	otpCode, err := getCachedData(key)
+func GetCachedOTPCode(ctx context.Context, identifier string) (string, error) {
+	key := utils.GetOTPCodeKey(identifier)
+	otpCode, err := getCachedData(ctx, key)
 
 	if err != nil {
 		utils.Log.Debug("Error : Failed to fetch OTP code from cache")
@@ -98,60 +329,139 @@ func GetCachedOTPCode(phoneNumber string) (string, error) {
 	return otpCodeString, nil
 }
 
-func SetOTPLock(phoneNumber string, value bool) error {
-	key := utils.GetOTPLockKey(phoneNumber)
-	timeout, err := utils.GetLockTimeout()
+// getLockPolicy reads the lock escalation from conf, all durations are in minutes like otp-lock-timeout
+func getLockPolicy() (store.LockPolicy, error) {
+	var policy store.LockPolicy
+	var err error
+	if policy.Timeout, err = utils.GetLockTimeout(); err != nil {
+		utils.Log.Debug("Error : Failed to fetch OTP lock timeout")
+		return policy, err
+	}
+	if policy.Multiplier, err = utils.GetIntFromConf("otp-lock-multiplier", 2); err != nil {
+		return policy, err
+	}
+	maxMinutes, err := utils.GetIntFromConf("otp-lock-max-timeout", 24*60)
+	if err != nil {
+		return policy, err
+	}
+	lookbackMinutes, err := utils.GetIntFromConf("otp-lock-lookback", 24*60)
+	if err != nil {
+		return policy, err
+	}
+	policy.Max = time.Minute * time.Duration(maxMinutes)
+	policy.Lookback = time.Minute * time.Duration(lookbackMinutes)
+	return policy, nil
+}
 
+// SetOTPLock locks the identifier one level above its locks within the lookback, for the lock timeout
+// of that level
+func SetOTPLock(ctx context.Context, identifier string) error {
+	key := utils.GetOTPLockKey(identifier)
+	policy, err := getLockPolicy()
 	if err != nil {
-		utils.Log.Debug("Error : Failed to fetch OTP lock timeout")
 		return err
 	}
-	if err := storeInCache(key, value, timeout); err != nil {
+
+	level, err := recordLockInCache(ctx, utils.GetOTPLockHistoryKey(identifier), policy.Lookback)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to store OTP lock history in cache")
+		return err
+	}
+	if err := storeInCache(ctx, key, level, policy.LockTimeout(level)); err != nil {
 		utils.Log.Debug("Error : Failed to store OTP lock in cache")
 		return err
 	}
 
-	utils.Log.Debug("Successfully stored OTP lock in cache")
+	utils.Log.Debug(fmt.Sprintf("Successfully stored OTP lock in cache, level : %d", level))
 	return nil
 }
 
-func GetOTPLock(phoneNumber string) (bool, int, error) {
-	key := utils.GetOTPLockKey(phoneNumber)
-	lockValue, err := getCachedData(key)
+// GetOTPLock returns the lock of the identifier, nil when it is not locked
+func GetOTPLock(ctx context.Context, identifier string) (*OTPLock, error) {
+	lock, err := getOTPLock(ctx, identifier)
+	if lock != nil {
+		metrics.LockHits.WithLabelValues("send").Inc()
+	}
+	return lock, err
+}
+
+func getOTPLock(ctx context.Context, identifier string) (*OTPLock, error) {
+	key := utils.GetOTPLockKey(identifier)
+	lockValue, err := getCachedData(ctx, key)
 
 	if err != nil {
 		utils.Log.Debug("Error : Failed to get OTP lock data from cache")
-		return false, -2, err
+		return nil, err
 	}
 	if lockValue == nil {
 		utils.Log.Debug("Lock data not present in cache")
-		return false, -2, nil
+		return nil, nil
 	}
 
-	ttl, err := getTTLData(key)
+	ttl, err := getTTLData(ctx, key)
 	if err != nil {
 		utils.Log.Debug("Error : Failed to load OTP lock ttl from cache")
-		return false, -2, err
+		return nil, err
+	}
+	if ttl == store.KeyMissing {
+		utils.Log.Debug("Lock expired while it was read")
+		return nil, nil
 	}
 
-	ttlInt := int(ttl.Minutes())
-	loackValueBool := lockValue == "1"
+	//locks stored by older versions hold "1", which reads as level 1
+	level, err := strconv.Atoi(lockValue.(string))
+	if err != nil || level < 1 {
+		level = 1
+	}
 
 	utils.Log.Debug("Successfully fetched OTP lock from cache")
-	return loackValueBool, ttlInt, nil
+	return &OTPLock{TTL: ttl, Level: level}, nil
 }
 
-func CleanUp(phoneNumber string) error {
-	otpCodeKey := utils.GetOTPCodeKey(phoneNumber)
-	otpTrialsLeftKey := utils.GetOTPTrialsLeftKey(phoneNumber)
+// MigrateLegacyLock moves a lock an older version stored under the legacy key to the current lock key
+// with the time it had left, so numbers locked before an upgrade stay locked after it. migrated is false
+// when key is not a legacy lock key or the lock is gone
+func MigrateLegacyLock(ctx context.Context, key string) (bool, error) {
+	identifier, ok := utils.ParseLegacyOTPLockKey(key)
+	if !ok {
+		return false, nil
+	}
+	ttl, err := getTTLData(ctx, key)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to load legacy OTP lock ttl from cache")
+		return false, err
+	}
+	if ttl == store.KeyMissing {
+		return false, nil
+	}
+	if ttl == store.NoExpiry {
+		ttl, err = utils.GetLockTimeout()
+		if err != nil {
+			return false, err
+		}
+	}
+	if _, err := storeInCacheIfAbsent(ctx, utils.GetOTPLockKey(identifier), 1, ttl); err != nil {
+		utils.Log.Debug("Error : Failed to carry over legacy OTP lock")
+		return false, err
+	}
+	if err := deleteDataFromCache(ctx, key); err != nil {
+		return false, err
+	}
+	utils.Log.Info("Carried over OTP lock from a legacy key")
+	return true, nil
+}
+
+func CleanUp(ctx context.Context, identifier string) error {
+	otpCodeKey := utils.GetOTPCodeKey(identifier)
+	otpTrialsLeftKey := utils.GetOTPTrialsLeftKey(identifier)
 
-	if err := deleteDataFromCache(otpCodeKey); err != nil {
+	if err := deleteDataFromCache(ctx, otpCodeKey); err != nil {
 		utils.Log.Debug("Error : Failed to delete OTP code from cache")
 		return err
 	}
 	utils.Log.Debug("Successfully deleted OTP code from cache")
 
-	if err := deleteDataFromCache(otpTrialsLeftKey); err != nil {
+	if err := deleteDataFromCache(ctx, otpTrialsLeftKey); err != nil {
 		utils.Log.Debug("Error : Failed to delete OTP Trials left from cache")
 		return err
 	}
@@ -159,14 +469,76 @@ func CleanUp(phoneNumber string) error {
 	return nil
 }
 
-func DecrementOTPTrialsLeft(phoneNumber string) error {
-	key := utils.GetOTPTrialsLeftKey(phoneNumber)
-	err := decrementValueInCache(key)
+// VerifyOTPCode checks the code, counts a failed trial or locks the identifier in one atomic step
+func VerifyOTPCode(ctx context.Context, identifier string, OTPCode string) (store.VerifyResult, error) {
+	policy, err := getLockPolicy()
+	if err != nil {
+		return store.VerifyResult{}, err
+	}
+	keys := store.VerifyKeys{
+		Code:        utils.GetOTPCodeKey(identifier),
+		TrialsLeft:  utils.GetOTPTrialsLeftKey(identifier),
+		Lock:        utils.GetOTPLockKey(identifier),
+		LockHistory: utils.GetOTPLockHistoryKey(identifier),
+	}
 
+	submitted := OTPCode
+	if verifyService != nil {
+		submitted, err = checkWithVerifyService(ctx, identifier, OTPCode)
+		if err != nil {
+			utils.Log.Debug("Error : Failed to check OTP code with twilio verify")
+			return store.VerifyResult{}, err
+		}
+	}
+
+	result, err := verifyInCache(ctx, keys, submitted, policy)
 	if err != nil {
-		utils.Log.Debug("Error : Failed to decrement OTP trials left in cache")
-		return err
+		utils.Log.Debug("Error : Failed to verify OTP code in cache")
+		return result, err
 	}
-	utils.Log.Debug("Successfully decremented OTP trials left in cache")
-	return nil
+	if result.Outcome == store.Verified {
+		//the code is consumed either way, a verification that misses the approval expires instead
+		if err := recordApproval(ctx, identifier); err != nil {
+			utils.Log.Warn(fmt.Sprintf("Failed to record approval : %s", err.Error()))
+		}
+	}
+
+	outcome := result.Outcome.String()
+	if result.LockedNow {
+		outcome = "max_limit_lock"
+	}
+	if result.Outcome == store.Locked {
+		metrics.LockHits.WithLabelValues("verify").Inc()
+	}
+	metrics.VerifyOutcomes.WithLabelValues(outcome).Inc()
+	utils.Log.Debug("Successfully verified OTP code in cache")
+	return result, nil
+}
+
+// verifyRejected is submitted to the cache in place of a code Twilio Verify did not approve. It never
+// equals a cached verification SID, so the failed trial is counted and the input the user sent is
+// never compared to the SID
+const verifyRejected = "rejected"
+
+// checkWithVerifyService asks Twilio Verify about the code and returns what to submit to the cache:
+// the cached verification SID when approved, so it is consumed, or verifyRejected so the failed trial
+// is counted. Locked identifiers and expired verifications never reach twilio
+func checkWithVerifyService(ctx context.Context, identifier string, OTPCode string) (string, error) {
+	lock, err := getOTPLock(ctx, identifier)
+	if err != nil || lock != nil {
+		return verifyRejected, err
+	}
+	verificationSid, err := GetCachedOTPCode(ctx, identifier)
+	if err != nil || verificationSid == "" {
+		return verifyRejected, err
+	}
+
+	approved, err := verifyService.Check(ctx, verificationSid, OTPCode)
+	if err != nil {
+		return "", err
+	}
+	if approved {
+		return verificationSid, nil
+	}
+	return verifyRejected, nil
 }
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/store"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+// fakeSender fails every send with err, during runs while the message is on its way
+type fakeSender struct {
+	err    error
+	during func(ctx context.Context)
+	sent   []sender.Message
+}
+
+func (s *fakeSender) Send(ctx context.Context, message sender.Message) (sender.Result, error) {
+	s.sent = append(s.sent, message)
+	if s.during != nil {
+		s.during(ctx)
+	}
+	if s.err != nil {
+		return sender.Result{}, s.err
+	}
+	return sender.Result{MessageID: "SM1", Status: "queued"}, nil
+}
+
+// failingStore fails every Set of key
+type failingStore struct {
+	store.OTPStore
+	key string
+}
+
+func (s failingStore) Set(ctx context.Context, key string, value string, expiry time.Duration) error {
+	if key == s.key {
+		return errors.New("store unavailable")
+	}
+	return s.OTPStore.Set(ctx, key, value, expiry)
+}
+
+// sentCode stands for the code IssueOTP sent in the expectations
+const sentCode = "<sent>"
+
+func TestIssueOTPRollback(t *testing.T) {
+	codeKey := utils.GetOTPCodeKey(testIdentifier)
+	trialsKey := utils.GetOTPTrialsLeftKey(testIdentifier)
+	maxTrials, err := utils.GetOTPMaxTrials()
+	if err != nil {
+		t.Fatalf("GetOTPMaxTrials() error = %v", err)
+	}
+	previous := func(ctx context.Context, s store.OTPStore) {
+		s.Set(ctx, codeKey, "111111", time.Hour)
+		s.Set(ctx, trialsKey, "2", time.Hour)
+	}
+
+	tests := []struct {
+		name       string
+		before     func(ctx context.Context, s store.OTPStore)
+		failKey    string
+		sendErr    error
+		during     func(ctx context.Context)
+		wantErr    bool
+		wantCode   string
+		wantTrials string
+	}{
+		{name: "sent", wantCode: sentCode, wantTrials: strconv.Itoa(maxTrials)},
+		{name: "sent over a previous code", before: previous, wantCode: sentCode, wantTrials: strconv.Itoa(maxTrials)},
+		{name: "rejected", sendErr: &sender.HTTPProviderError{StatusCode: 400},
+			wantErr: true},
+		{name: "rejected restores the previous code", before: previous, sendErr: &sender.HTTPProviderError{StatusCode: 400},
+			wantErr: true, wantCode: "111111", wantTrials: "2"},
+		{name: "refused connection restores the previous code", before: previous,
+			sendErr: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED},
+			wantErr: true, wantCode: "111111", wantTrials: "2"},
+		{name: "trials not cached restores the previous code", before: previous, failKey: trialsKey,
+			wantErr: true, wantCode: "111111", wantTrials: "2"},
+		{name: "deadline keeps the code", before: previous, sendErr: context.DeadlineExceeded,
+			wantErr: true, wantCode: sentCode, wantTrials: strconv.Itoa(maxTrials)},
+		{name: "read timeout keeps the code", before: previous,
+			sendErr: &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded},
+			wantErr: true, wantCode: sentCode, wantTrials: strconv.Itoa(maxTrials)},
+		{name: "newer code is kept", before: previous, sendErr: &sender.HTTPProviderError{StatusCode: 503},
+			during: func(ctx context.Context) {
+				otpStore.Set(ctx, codeKey, "999999", time.Hour)
+			},
+			wantErr: true, wantCode: "999999", wantTrials: strconv.Itoa(maxTrials)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			memory := store.NewMemoryStore()
+			if tt.before != nil {
+				tt.before(ctx, memory)
+			}
+			SetStore(failingStore{OTPStore: memory, key: tt.failKey})
+			fake := &fakeSender{err: tt.sendErr, during: tt.during}
+			SetSender(fake)
+
+			_, _, err := IssueOTP(ctx, OTPData{PhoneNumber: "+14155552671"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("IssueOTP() error = %v, want error %t", err, tt.wantErr)
+			}
+
+			wantCode := tt.wantCode
+			if wantCode == sentCode {
+				if len(fake.sent) != 1 {
+					t.Fatalf("%d messages sent, want 1", len(fake.sent))
+				}
+				wantCode = fake.sent[0].Code
+			}
+			if code, _, _ := memory.Get(ctx, codeKey); code != wantCode {
+				t.Errorf("cached code = %q, want %q", code, wantCode)
+			}
+			if trials, _, _ := memory.Get(ctx, trialsKey); trials != tt.wantTrials {
+				t.Errorf("cached trials = %q, want %q", trials, tt.wantTrials)
+			}
+		})
+	}
+}
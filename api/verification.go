@@ -0,0 +1,273 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/store"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+// getVerificationRetention is how long a verification can be looked up after it was created, 24 hours by default
+func getVerificationRetention() (time.Duration, error) {
+	return utils.GetSecondsFromConf("verification-retention", 24*time.Hour)
+}
+
+// CreateVerification issues a new code like send-otp, queued in async send mode, and returns the
+// verification it can be checked against. taken are the limits counted for the code
+func CreateVerification(ctx context.Context, data OTPData, taken *takenLimits) (*Verification, error) {
+	issue := IssueOTP
+	if sendQueue != nil {
+		issue = func(ctx context.Context, data OTPData) (*Delivery, int, error) {
+			return EnqueueOTP(ctx, data, taken)
+		}
+	}
+	delivery, otpTrials, err := issue(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	otpTimeout, err := utils.GetOTPTimeout()
+	if err != nil {
+		utils.Log.Debug("Error : Failed to fetch OTP timeout from conf")
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	record := &verificationRecord{
+		Verification: Verification{
+			ID:         delivery.VerificationID,
+			Status:     STATUS_PENDING,
+			To:         data.Destination(),
+			Channel:    data.DeliveryChannel(),
+			TrialsLeft: otpTrials,
+			CreatedAt:  now,
+			ExpiresAt:  now.Add(otpTimeout),
+		},
+		Identifier: data.Identifier(),
+	}
+	if err := saveVerification(ctx, record); err != nil {
+		return nil, err
+	}
+	return &record.Verification, nil
+}
+
+// GetVerification returns the verification with its current status, nil when there is none
+func GetVerification(ctx context.Context, verificationID string) (*Verification, error) {
+	record, err := getVerificationRecord(ctx, verificationID)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	if err := refreshVerification(ctx, record); err != nil {
+		return nil, err
+	}
+	return &record.Verification, nil
+}
+
+// CheckVerification checks code against a pending verification with the same trials and lock as
+// verify-otp. checked is false when the verification was no longer pending, nil when there is none
+func CheckVerification(ctx context.Context, verificationID string, code string) (*Verification, bool, error) {
+	record, err := getVerificationRecord(ctx, verificationID)
+	if err != nil || record == nil {
+		return nil, false, err
+	}
+	if err := refreshVerification(ctx, record); err != nil {
+		return nil, false, err
+	}
+	if record.Status != STATUS_PENDING {
+		return &record.Verification, false, nil
+	}
+
+	result, err := VerifyOTPCode(ctx, record.Identifier, code)
+	if err != nil {
+		return nil, false, err
+	}
+	record.TrialsLeft = 0
+	switch {
+	case result.Outcome == store.Locked, result.LockedNow:
+		record.Status = STATUS_LOCKED
+		record.LockTTL = int(result.LockTTL.Seconds())
+		record.LockLevel = result.LockLevel
+	case result.Outcome == store.Verified:
+		record.Status = STATUS_APPROVED
+	case result.Outcome == store.Expired:
+		record.Status = STATUS_EXPIRED
+	default:
+		record.TrialsLeft = result.TrialsLeft
+	}
+	if record.Status != STATUS_PENDING {
+		if err := saveVerification(ctx, record); err != nil {
+			return nil, false, err
+		}
+	}
+	return &record.Verification, true, nil
+}
+
+// CancelVerification deletes the code of a pending verification so it can no longer be approved.
+// canceled is false when the verification was no longer pending, nil when there is none
+func CancelVerification(ctx context.Context, verificationID string) (*Verification, bool, error) {
+	record, err := getVerificationRecord(ctx, verificationID)
+	if err != nil || record == nil {
+		return nil, false, err
+	}
+	if err := refreshVerification(ctx, record); err != nil {
+		return nil, false, err
+	}
+	if record.Status != STATUS_PENDING {
+		return &record.Verification, false, nil
+	}
+
+	if verifyService != nil {
+		verificationSid, err := GetCachedOTPCode(ctx, record.Identifier)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := verifyService.Cancel(ctx, verificationSid); err != nil {
+			return nil, false, err
+		}
+	}
+	for _, key := range []string{
+		utils.GetOTPCodeKey(record.Identifier),
+		utils.GetVoiceTokenKey(record.Identifier),
+		utils.GetDeliveryKey(record.Identifier),
+	} {
+		if err := deleteDataFromCache(ctx, key); err != nil {
+			return nil, false, err
+		}
+	}
+	record.Status = STATUS_CANCELED
+	record.TrialsLeft = 0
+	if err := saveVerification(ctx, record); err != nil {
+		return nil, false, err
+	}
+	utils.Log.Debug("Successfully canceled verification")
+	return &record.Verification, true, nil
+}
+
+// refreshVerification works out the status of a pending verification from the state of its identifier:
+// a newer code or a failed queued send cancels it, a lock locks it, an approval recorded by verify-otp
+// approves it and it expires with its code. Final statuses are stored, a locked verification reports
+// the time left on the lock
+func refreshVerification(ctx context.Context, record *verificationRecord) error {
+	lock, err := getOTPLock(ctx, record.Identifier)
+	if err != nil {
+		return err
+	}
+	if record.Status == STATUS_LOCKED {
+		record.LockTTL = 0
+		if lock != nil {
+			record.LockTTL = int(lock.TTL.Seconds())
+		}
+		return nil
+	}
+	if record.Status != STATUS_PENDING {
+		return nil
+	}
+
+	delivery, err := GetDelivery(ctx, record.Identifier)
+	if err != nil {
+		return err
+	}
+	current := delivery != nil && delivery.VerificationID == record.ID
+	code := ""
+	approved := false
+	if current {
+		if code, err = GetCachedOTPCode(ctx, record.Identifier); err != nil {
+			return err
+		}
+	}
+	if current && code == "" {
+		if approved, err = isApproved(ctx, record); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case !current && time.Now().After(record.ExpiresAt):
+		record.Status = STATUS_EXPIRED
+	case !current:
+		record.Status = STATUS_CANCELED
+	case lock != nil:
+		record.Status = STATUS_LOCKED
+		record.LockTTL = int(lock.TTL.Seconds())
+		record.LockLevel = lock.Level
+	case code == "" && len(delivery.Attempts) == 0:
+		//a queued code the send workers gave up on was never sent
+		record.Status = STATUS_CANCELED
+	case approved:
+		record.Status = STATUS_APPROVED
+	case code == "" && time.Now().After(record.ExpiresAt):
+		record.Status = STATUS_EXPIRED
+	case code == "":
+		//verify-otp consumed the code and is about to record the approval
+		record.TrialsLeft = 0
+		return nil
+	default:
+		trials, err := GetOTPTrialsLeft(ctx, record.Identifier)
+		if err != nil {
+			return err
+		}
+		record.TrialsLeft = max(0, trials)
+		return nil
+	}
+	record.TrialsLeft = 0
+	return saveVerification(ctx, record)
+}
+
+// recordApproval marks the current verification of the identifier approved for as long as verifications
+// are kept, so its status does not depend on why the code is gone
+func recordApproval(ctx context.Context, identifier string) error {
+	delivery, err := GetDelivery(ctx, identifier)
+	if err != nil || delivery == nil {
+		return err
+	}
+	retention, err := getVerificationRetention()
+	if err != nil {
+		return err
+	}
+	return storeInCache(ctx, utils.GetApprovedKey(identifier, delivery.VerificationID), true, retention)
+}
+
+func isApproved(ctx context.Context, record *verificationRecord) (bool, error) {
+	approved, err := getCachedData(ctx, utils.GetApprovedKey(record.Identifier, record.ID))
+	return approved != nil, err
+}
+
+func getVerificationRecord(ctx context.Context, verificationID string) (*verificationRecord, error) {
+	cached, err := getCachedData(ctx, utils.GetVerificationKey(verificationID))
+	if err != nil {
+		utils.Log.Debug("Error : Failed to fetch verification from cache")
+		return nil, err
+	}
+	if cached == nil {
+		utils.Log.Debug("Verification not present in cache")
+		return nil, nil
+	}
+	var record verificationRecord
+	if err := json.Unmarshal([]byte(cached.(string)), &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// saveVerification stores the verification until the retention from its creation is over
+func saveVerification(ctx context.Context, record *verificationRecord) error {
+	retention, err := getVerificationRetention()
+	if err != nil {
+		return err
+	}
+	expiry := time.Until(record.CreatedAt.Add(retention))
+	if expiry < time.Second {
+		expiry = time.Second
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := storeInCache(ctx, utils.GetVerificationKey(record.ID), string(value), expiry); err != nil {
+		utils.Log.Debug("Error : Failed to store verification in cache")
+		return err
+	}
+	utils.Log.Debug("Successfully stored verification in cache")
+	return nil
+}
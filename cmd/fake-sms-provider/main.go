@@ -0,0 +1,114 @@
+// fake-sms-provider is a local stand-in for an HTTP SMS provider, to try the sms router without
+// a real account. It accepts POST /sms, keeps messages in memory and lists them at GET /messages
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type message struct {
+	ID         string          `json:"id"`
+	To         string          `json:"to,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Form       string          `json:"form,omitempty"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+}
+
+type provider struct {
+	token    string
+	failRate float64
+	delay    time.Duration
+
+	mu       sync.Mutex
+	messages []message
+}
+
+func main() {
+	addr := flag.String("addr", ":4010", "listen address")
+	token := flag.String("token", "", "bearer token requests must carry, none when empty")
+	failRate := flag.Float64("fail-rate", 0, "share of requests answered with 503, between 0 and 1")
+	delay := flag.Duration("delay", 0, "time to wait before answering")
+	flag.Parse()
+
+	p := &provider{token: *token, failRate: *failRate, delay: *delay}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sms", p.send)
+	mux.HandleFunc("/messages", p.list)
+
+	log.Printf("fake sms provider listening at %s, fail rate %.2f", *addr, *failRate)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+func (p *provider) send(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.token != "" && r.Header.Get("Authorization") != "Bearer "+p.token {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+		return
+	}
+	time.Sleep(p.delay)
+	if rand.Float64() < p.failRate {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "provider unavailable"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	msg := message{ReceivedAt: time.Now().UTC()}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var fields map[string]any
+		if err := json.Unmarshal(body, &fields); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+			return
+		}
+		msg.To = fmt.Sprint(fields["to"])
+		msg.Payload = body
+	} else {
+		msg.Form = string(body)
+	}
+	if to := r.URL.Query().Get("to"); to != "" {
+		msg.To = to
+	}
+
+	p.mu.Lock()
+	msg.ID = fmt.Sprintf("fake-%d", len(p.messages)+1)
+	p.messages = append(p.messages, msg)
+	p.mu.Unlock()
+
+	log.Printf("message %s to %s : %s%s", msg.ID, msg.To, msg.Payload, msg.Form)
+	writeJSON(w, http.StatusOK, map[string]string{"id": msg.ID, "status": "accepted"})
+}
+
+func (p *provider) list(w http.ResponseWriter, r *http.Request) {
+	to := r.URL.Query().Get("to")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	messages := make([]message, 0, len(p.messages))
+	for _, msg := range p.messages {
+		if to == "" || msg.To == to {
+			messages = append(messages, msg)
+		}
+	}
+	writeJSON(w, http.StatusOK, messages)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
@@ -1,11 +1,23 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	router "github.com/pi-prakhar/go-redis-twilio-phone-otp/api"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/config"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/database"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/deadletter"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/health"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/queue"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/store"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/tracing"
 	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
 	loader "github.com/pi-prakhar/utils/loader"
 )
@@ -45,6 +57,54 @@ func main() {
 		}
 	}
 
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		utils.Log.Error("Failed to initialize tracing", err)
+	}
+
+	otpSender, err := sender.New()
+	if err != nil {
+		utils.Log.Error("Failed to create OTP sender", err)
+	}
+	router.SetSender(otpSender)
+
+	otpStore, err := store.New()
+	if err != nil {
+		utils.Log.Error("Failed to create OTP store", err)
+	}
+	router.SetStore(otpStore)
+
+	if err := router.CheckLimits(); err != nil {
+		utils.Log.Error("Failed to load rate limits from conf", err)
+	}
+
+	//failed sends are kept for inspection and replay with otpctl, which needs redis
+	if _, ok := otpStore.(*store.RedisStore); ok {
+		deadLetters, err := deadletter.New()
+		if err != nil {
+			utils.Log.Error("Failed to create dead-letter store", err)
+		}
+		router.SetDeadLetters(deadLetters)
+	}
+
+	backend, err := utils.GetStringFromConf("otp-backend", router.LOCAL_BACKEND)
+	if err != nil {
+		utils.Log.Error("Failed to load otp-backend from conf", err)
+	}
+	var verifyService *sender.VerifyService
+	switch backend {
+	case router.LOCAL_BACKEND:
+	case router.TWILIO_VERIFY_BACKEND:
+		verifyService = sender.NewVerifyService()
+		router.SetVerifyService(verifyService)
+	default:
+		utils.Log.Error("Failed to configure OTP backend", fmt.Errorf("unknown otp-backend '%s'", backend))
+	}
+
+	stopWorkers := startSendQueue(verifyService)
+
+	router.SetHealthChecker(newHealthChecker(otpSender, otpStore, verifyService))
+
 	srv := &http.Server{
 		Handler:      router.New(),
 		Addr:         domain,
@@ -52,5 +112,181 @@ func main() {
 		ReadTimeout:  15 * time.Second,
 	}
 
-	utils.Log.Error(fmt.Sprintf("could not start server at : %s", domain), srv.ListenAndServe())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	//metrics and pool stats are internal, they are only served on the admin address
+	adminAddr, err := utils.GetStringFromConf("admin-addr", "127.0.0.1:9090")
+	if err != nil {
+		utils.Log.Error("Failed to load admin-addr from conf", err)
+	}
+	var adminSrv *http.Server
+	if adminAddr != "" {
+		adminSrv = &http.Server{
+			Handler:      router.NewAdmin(),
+			Addr:         adminAddr,
+			WriteTimeout: 15 * time.Second,
+			ReadTimeout:  15 * time.Second,
+		}
+	}
+
+	serveErr := make(chan error, 2)
+	go func() {
+		utils.Log.Info(fmt.Sprintf("Server listening at : %s", domain))
+		serveErr <- srv.ListenAndServe()
+	}()
+	if adminSrv != nil {
+		go func() {
+			utils.Log.Info(fmt.Sprintf("Admin server listening at : %s", adminAddr))
+			serveErr <- adminSrv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		database.Close()
+		utils.Log.Error(fmt.Sprintf("could not start server at : %s or %s", domain, adminAddr), err)
+	case <-ctx.Done():
+		stop()
+		utils.Log.Info("Shutdown signal received, draining requests")
+	}
+
+	shutdown(srv, adminSrv, shutdownTracing, stopWorkers)
+}
+
+// startSendQueue sets up async sends when "send-mode" is async and starts the in-process send workers,
+// the returned func stops them and waits for the sends in flight
+func startSendQueue(verifyService *sender.VerifyService) func() {
+	mode, err := utils.GetStringFromConf("send-mode", router.SYNC_SEND)
+	if err != nil {
+		utils.Log.Error("Failed to load send-mode from conf", err)
+	}
+	switch mode {
+	case router.SYNC_SEND:
+		//the timeout fallback is scheduled on the send queue, without it the setting would do nothing
+		enabled, _ := utils.GetBoolFromConf("otp-fallback-enabled", false)
+		if after, _ := utils.GetSecondsFromConf("otp-fallback-after", 0); enabled && after > 0 {
+			utils.Log.Error("Failed to configure channel fallback", fmt.Errorf("otp-fallback-after needs send-mode '%s'", router.ASYNC_SEND))
+		}
+		return func() {}
+	case router.ASYNC_SEND:
+	default:
+		utils.Log.Error("Failed to configure send mode", fmt.Errorf("unknown send-mode '%s'", mode))
+	}
+	if verifyService != nil {
+		utils.Log.Error("Failed to configure send mode", fmt.Errorf("send-mode async needs otp-backend '%s'", router.LOCAL_BACKEND))
+	}
+
+	sendQueue, err := queue.New()
+	if err != nil {
+		utils.Log.Error("Failed to create send queue", err)
+	}
+	router.SetQueue(sendQueue)
+
+	workers, err := utils.GetIntFromConf("queue-workers", 4)
+	if err != nil {
+		utils.Log.Error("Failed to load queue-workers from conf", err)
+	}
+	if workers <= 0 {
+		utils.Log.Info("No in-process send workers, jobs are left to otp-worker")
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := router.RunWorkers(ctx, queue.ConsumerName(), workers); err != nil {
+			utils.Log.Warn(fmt.Sprintf("Send workers failed : %s", err))
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// newHealthChecker registers a check for every dependency the service was started with
+func newHealthChecker(otpSender sender.Sender, otpStore store.OTPStore, verifyService *sender.VerifyService) *health.Checker {
+	timeout, err := utils.GetSecondsFromConf("health-check-timeout", 2*time.Second)
+	if err != nil {
+		utils.Log.Warn("Failed to load health-check-timeout from conf, using 2 seconds")
+	}
+	cacheTTL, err := utils.GetSecondsFromConf("health-cache-ttl", 5*time.Second)
+	if err != nil {
+		utils.Log.Warn("Failed to load health-cache-ttl from conf, using 5 seconds")
+	}
+
+	checks := []health.Check{
+		{
+			Name:     "config",
+			Liveness: true,
+			Run: func(ctx context.Context) error {
+				return utils.CheckConf()
+			},
+		},
+	}
+	if _, ok := otpStore.(*store.RedisStore); ok {
+		checks = append(checks, health.Check{Name: "redis", Run: otpStore.Ping})
+	}
+	if verifyService != nil {
+		checks = append(checks, health.Check{
+			Name: "twilio",
+			Run: func(ctx context.Context) error {
+				return config.CheckTwilioCredentials("TWILIO_SERVICES_ID")
+			},
+		})
+	} else if sender.UsesTwilio(otpSender) {
+		checks = append(checks, health.Check{
+			Name: "twilio",
+			Run: func(ctx context.Context) error {
+				return config.CheckTwilioCredentials()
+			},
+		})
+	}
+	return health.NewChecker(timeout, cacheTTL, checks...)
+}
+
+// shutdown fails readiness, waits for load balancers to notice, then stops accepting connections
+// and lets in-flight requests finish within the grace period, then waits for the sends of the workers before closing
+// redis and flushing spans. The admin server, when there is one, stays up until the api is drained
+func shutdown(srv *http.Server, adminSrv *http.Server, shutdownTracing func(context.Context) error, stopWorkers func()) {
+	router.SetDraining(true)
+
+	readinessDelay, err := utils.GetSecondsFromConf("shutdown-readiness-delay", 0)
+	if err != nil {
+		utils.Log.Warn("Failed to load shutdown-readiness-delay from conf, not waiting")
+	}
+	time.Sleep(readinessDelay)
+
+	gracePeriod, err := utils.GetSecondsFromConf("shutdown-grace-period", 20*time.Second)
+	if err != nil {
+		utils.Log.Warn("Failed to load shutdown-grace-period from conf, using 20 seconds")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		utils.Log.Warn(fmt.Sprintf("Grace period over, closing remaining connections : %s", err))
+		srv.Close()
+	} else {
+		utils.Log.Info("Successfully drained in-flight requests")
+	}
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(ctx); err != nil {
+			adminSrv.Close()
+		}
+	}
+
+	stopWorkers()
+
+	if err := database.Close(); err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to close redis client : %s", err))
+	}
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if err := shutdownTracing(flushCtx); err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to flush spans : %s", err))
+	}
+	utils.Log.Info("Server stopped")
+	os.Stdout.Sync()
 }
@@ -0,0 +1,93 @@
+// otp-worker delivers the OTP messages the service queues in async send mode. It reads the same
+// config as the service, set "queue-workers" of the service to 0 to leave every job to these workers
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	router "github.com/pi-prakhar/go-redis-twilio-phone-otp/api"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/database"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/deadletter"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/queue"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/store"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/tracing"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	loader "github.com/pi-prakhar/utils/loader"
+)
+
+func init() {
+	utils.InitLogger()
+	utils.Log.Info("OTP-WORKER Logger Started")
+
+	if err := loader.LoadEnv(); err != nil {
+		utils.Log.Error("Failed to Load ENV", err)
+	}
+}
+
+func main() {
+	workers := flag.Int("workers", 4, "number of concurrent send workers")
+	flag.Parse()
+
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		utils.Log.Error("Failed to initialize tracing", err)
+	}
+
+	otpSender, err := sender.New()
+	if err != nil {
+		utils.Log.Error("Failed to create OTP sender", err)
+	}
+	router.SetSender(otpSender)
+
+	otpStore, err := store.New()
+	if err != nil {
+		utils.Log.Error("Failed to create OTP store", err)
+	}
+	router.SetStore(otpStore)
+
+	//failed sends are kept for inspection and replay with otpctl, which needs redis
+	if _, ok := otpStore.(*store.RedisStore); ok {
+		deadLetters, err := deadletter.New()
+		if err != nil {
+			utils.Log.Error("Failed to create dead-letter store", err)
+		}
+		router.SetDeadLetters(deadLetters)
+	}
+
+	backend, err := utils.GetStringFromConf("otp-backend", router.LOCAL_BACKEND)
+	if err != nil || backend != router.LOCAL_BACKEND {
+		utils.Log.Error("Failed to configure OTP backend", fmt.Errorf("otp-worker needs otp-backend '%s'", router.LOCAL_BACKEND))
+	}
+
+	sendQueue, err := queue.New()
+	if err != nil {
+		utils.Log.Error("Failed to create send queue", err)
+	}
+	router.SetQueue(sendQueue)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	//RunWorkers returns once the signal arrived and the sends in flight are done
+	if err := router.RunWorkers(ctx, queue.ConsumerName(), max(1, *workers)); err != nil {
+		utils.Log.Error("Failed to run send workers", err)
+	}
+
+	if err := database.Close(); err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to close redis client : %s", err))
+	}
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if err := shutdownTracing(flushCtx); err != nil {
+		utils.Log.Warn(fmt.Sprintf("Failed to flush spans : %s", err))
+	}
+	utils.Log.Info("Worker stopped")
+	os.Stdout.Sync()
+}
@@ -0,0 +1,337 @@
+// otpctl is the operator command line of the OTP service. It reads the same config and .env as the
+// service and talks to its redis.
+//
+//	otpctl dead-letters list    [filters]
+//	otpctl dead-letters inspect <id>...
+//	otpctl dead-letters purge   [filters] [-all] [<id>...]
+//	otpctl dead-letters replay  [filters] [-dry-run] [<id>...]
+//	otpctl migrate legacy-locks [-dry-run]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	router "github.com/pi-prakhar/go-redis-twilio-phone-otp/api"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/database"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/deadletter"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/sender"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/store"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	loader "github.com/pi-prakhar/utils/loader"
+	loggerUtil "github.com/pi-prakhar/utils/logger"
+)
+
+const usage = `usage: otpctl dead-letters <command> [flags] [<id>...]
+       otpctl migrate legacy-locks [-dry-run]
+
+commands:
+  list      list codes that did not reach the user
+  inspect   show them by id
+  purge     delete them by id or filter
+  replay    send a new code to their destinations, by id or filter
+
+filters:
+  -since     RFC3339 time or duration before now, e.g. 24h
+  -until     RFC3339 time or duration before now
+  -code      provider error code, e.g. 21211, 503, timeout or breaker_open
+  -channel   sms, voice, whatsapp or email
+  -limit     maximum number of entries, 0 for all
+
+migrate legacy-locks moves the locks versions before namespaced keys stored under +14155552671_lock
+or {+14155552671}_lock to the current key with the time they have left. Run it once after upgrading
+`
+
+// errUsage makes main print the usage
+var errUsage = errors.New("usage")
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "otpctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// run executes the command in args. It returns errors instead of exiting, so the redis client is
+// closed and the signal handler stopped before main exits
+func run(args []string) error {
+	if len(args) >= 2 && args[0] == "migrate" && args[1] == "legacy-locks" {
+		flags := flag.NewFlagSet("legacy-locks", flag.ExitOnError)
+		flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+		dryRun := flags.Bool("dry-run", false, "list the locks migrate would move")
+		flags.Parse(args[2:])
+		return migrateLegacyLocks(*dryRun)
+	}
+	if len(args) < 2 || args[0] != "dead-letters" {
+		return errUsage
+	}
+	command, args := args[1], args[2:]
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	since := flags.String("since", "", "")
+	until := flags.String("until", "", "")
+	code := flags.String("code", "", "")
+	channel := flags.String("channel", "", "")
+	limit := flags.Int("limit", 0, "")
+	all := flags.Bool("all", false, "purge every entry matching the filters, needed without ids")
+	dryRun := flags.Bool("dry-run", false, "list what replay would send")
+	verbose := flags.Bool("v", false, "log like the service does")
+	flags.Parse(args)
+
+	filter := deadletter.Filter{ErrorCode: *code, Channel: *channel, Limit: *limit}
+	var err error
+	if filter.Since, err = parseTime(*since); err != nil {
+		return err
+	}
+	if filter.Until, err = parseTime(*until); err != nil {
+		return err
+	}
+
+	err = setUp(*verbose)
+	defer database.Close()
+	if err != nil {
+		return err
+	}
+	deadLetters, err := deadletter.New()
+	if err != nil {
+		return err
+	}
+	router.SetDeadLetters(deadLetters)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	ids := flags.Args()
+	switch command {
+	case "list":
+		entries, err := deadLetters.List(ctx, filter)
+		if err != nil {
+			return err
+		}
+		printEntries(entries)
+	case "inspect":
+		if len(ids) == 0 {
+			return errors.New("inspect needs at least one id")
+		}
+		entries, err := getEntries(ctx, deadLetters, ids)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case "purge":
+		entries, err := selectEntries(ctx, deadLetters, ids, filter)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 && !*all {
+			return fmt.Errorf("purge would delete %d entries, pass -all to confirm or give ids", len(entries))
+		}
+		purge := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			purge = append(purge, entry.ID)
+		}
+		deleted, err := deadLetters.Delete(ctx, purge...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("purged %d entries\n", deleted)
+	case "replay":
+		entries, err := selectEntries(ctx, deadLetters, ids, filter)
+		if err != nil {
+			return err
+		}
+		if *dryRun {
+			printEntries(entries)
+			return nil
+		}
+		replay(ctx, entries)
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// setUp loads env and conf and wires the store and sender the way the service does
+func setUp(verbose bool) error {
+	utils.InitLogger()
+	if !verbose {
+		//logs share stdout with the results, keep them to warnings
+		utils.Log = loggerUtil.New(loggerUtil.WARN, "otpctl")
+		loader.Logger = loggerUtil.New(loggerUtil.WARN, "otpctl")
+	}
+	if err := loader.LoadEnv(); err != nil {
+		return fmt.Errorf("failed to load env : %w", err)
+	}
+
+	otpStore, err := store.New()
+	if err != nil {
+		return fmt.Errorf("failed to create OTP store : %w", err)
+	}
+	router.SetStore(otpStore)
+
+	otpSender, err := sender.New()
+	if err != nil {
+		return fmt.Errorf("failed to create OTP sender : %w", err)
+	}
+	router.SetSender(otpSender)
+
+	backend, err := utils.GetStringFromConf("otp-backend", router.LOCAL_BACKEND)
+	if err != nil {
+		return fmt.Errorf("failed to load otp-backend from conf : %w", err)
+	}
+	if backend == router.TWILIO_VERIFY_BACKEND {
+		router.SetVerifyService(sender.NewVerifyService())
+	}
+	return nil
+}
+
+// migrateLegacyLocks scans every redis node for lock keys of older versions and moves them
+func migrateLegacyLocks(dryRun bool) error {
+	err := setUp(false)
+	defer database.Close()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	keys, err := scanKeys(ctx, "*_"+utils.OTP_LOCK)
+	if err != nil {
+		return err
+	}
+	migrated := 0
+	for _, key := range keys {
+		if _, ok := utils.ParseLegacyOTPLockKey(key); !ok {
+			continue
+		}
+		if dryRun {
+			fmt.Println(key)
+			continue
+		}
+		moved, err := router.MigrateLegacyLock(ctx, key)
+		if err != nil {
+			return err
+		}
+		if moved {
+			fmt.Println(key)
+			migrated++
+		}
+	}
+	if !dryRun {
+		fmt.Printf("migrated %d locks\n", migrated)
+	}
+	return nil
+}
+
+// scanKeys returns the keys matching pattern on every master, legacy keys are not hash tagged so they
+// are spread over the whole cluster
+func scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	rdb := database.Client()
+	if rdb == nil {
+		return nil, fmt.Errorf("migrating locks needs otp-store redis : %w", database.ErrNotInitialized)
+	}
+	var mu sync.Mutex
+	keys := []string{}
+	scan := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, pattern, 1000).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			keys = append(keys, iter.Val())
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+	if cluster, ok := rdb.(*redis.ClusterClient); ok {
+		err := cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+		return keys, err
+	}
+	return keys, scan(ctx, rdb)
+}
+
+// parseTime reads an RFC3339 time or a duration before now, empty is the zero time
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' is neither an RFC3339 time nor a duration", value)
+	}
+	return t, nil
+}
+
+func getEntries(ctx context.Context, deadLetters *deadletter.Store, ids []string) ([]deadletter.Entry, error) {
+	entries := make([]deadletter.Entry, 0, len(ids))
+	for _, id := range ids {
+		entry, err := deadLetters.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// selectEntries returns the entries with ids, or the entries matching filter when no id is given
+func selectEntries(ctx context.Context, deadLetters *deadletter.Store, ids []string, filter deadletter.Filter) ([]deadletter.Entry, error) {
+	if len(ids) > 0 {
+		return getEntries(ctx, deadLetters, ids)
+	}
+	return deadLetters.List(ctx, filter)
+}
+
+func replay(ctx context.Context, entries []deadletter.Entry) {
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		entryCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		outcome, err := router.ReplayDeadLetter(entryCtx, entry)
+		cancel()
+		if err != nil && outcome == "" {
+			outcome = "error"
+		}
+		counts[outcome]++
+		if err != nil {
+			fmt.Printf("%s\t%s\t%s\t%s\n", entry.ID, entry.Destination, outcome, err)
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\n", entry.ID, entry.Destination, outcome)
+	}
+	fmt.Printf("replayed %d entries : %d sent, %d failed, %d locked, %d limited, %d superseded, %d errors\n", len(entries),
+		counts[router.REPLAY_SENT], counts[router.REPLAY_FAILED], counts[router.REPLAY_LOCKED], counts[router.REPLAY_LIMITED],
+		counts[router.REPLAY_SUPERSEDED], counts["error"])
+}
+
+func printEntries(entries []deadletter.Entry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFAILED AT\tDESTINATION\tCHANNEL\tCODE\tATTEMPTS\tERROR")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", entry.ID, entry.FailedAt.Format(time.RFC3339),
+			entry.Destination, entry.Channel, entry.ErrorCode, entry.Attempts, entry.Error)
+	}
+	w.Flush()
+}
@@ -0,0 +1,207 @@
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// breaker states
+const (
+	CLOSED    = "closed"
+	OPEN      = "open"
+	HALF_OPEN = "half_open"
+)
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+// OpenError is returned while the breaker rejects calls, RetryAfter is when it lets a trial call through
+type OpenError struct {
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrOpen.Error(), e.RetryAfter.Round(time.Second))
+}
+
+func (e *OpenError) Unwrap() error {
+	return ErrOpen
+}
+
+// Config decides when the breaker opens: once at least MinRequests calls were made in the current
+// Window and the share of failures reaches FailureRatio. It stays open for OpenFor, then lets a single
+// trial call through which closes it on success and opens it again on failure
+type Config struct {
+	Window       time.Duration
+	MinRequests  int
+	FailureRatio float64
+	OpenFor      time.Duration
+}
+
+// DefaultConfig opens after half of at least 10 calls in a minute failed, for 30 seconds
+var DefaultConfig = Config{
+	Window:       time.Minute,
+	MinRequests:  10,
+	FailureRatio: 0.5,
+	OpenFor:      30 * time.Second,
+}
+
+// Breaker is a circuit breaker counting calls in fixed windows, it is safe for concurrent use
+type Breaker struct {
+	name     string
+	config   Config
+	onChange func(name string, state string)
+
+	mu          sync.Mutex
+	state       string
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+}
+
+// New builds a closed breaker, onChange is called with every state change and may be nil
+func New(name string, config Config, onChange func(name string, state string)) *Breaker {
+	b := &Breaker{
+		name:        name,
+		config:      config,
+		onChange:    onChange,
+		state:       CLOSED,
+		windowStart: time.Now(),
+	}
+	if onChange != nil {
+		onChange(name, CLOSED)
+	}
+	return b
+}
+
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// State returns the current state, an open breaker whose OpenFor has passed reports half open
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == OPEN && time.Since(b.openedAt) >= b.config.OpenFor {
+		return HALF_OPEN
+	}
+	return b.state
+}
+
+// Allow returns an *OpenError when the call must not be made, otherwise the outcome
+// of the call has to be reported with Record
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case OPEN:
+		if elapsed := now.Sub(b.openedAt); elapsed < b.config.OpenFor {
+			return &OpenError{Name: b.name, RetryAfter: b.config.OpenFor - elapsed}
+		}
+		b.setState(HALF_OPEN)
+		b.probing = true
+		return nil
+	case HALF_OPEN:
+		//one trial call at a time
+		if b.probing {
+			return &OpenError{Name: b.name, RetryAfter: time.Second}
+		}
+		b.probing = true
+		return nil
+	default:
+		if now.Sub(b.windowStart) >= b.config.Window {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+		return nil
+	}
+}
+
+// Record reports the outcome of a call that Allow let through, a nil err is a success
+func (b *Breaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == HALF_OPEN {
+		b.probing = false
+		if err != nil {
+			b.open()
+			return
+		}
+		b.windowStart = time.Now()
+		b.requests = 0
+		b.failures = 0
+		b.setState(CLOSED)
+		return
+	}
+	if b.state != CLOSED {
+		return
+	}
+
+	b.requests++
+	if err != nil {
+		b.failures++
+	}
+	if b.requests >= b.config.MinRequests && float64(b.failures)/float64(b.requests) >= b.config.FailureRatio {
+		b.open()
+	}
+}
+
+// Abandon reports that a call Allow let through ended without an outcome, e.g. the caller gave up
+func (b *Breaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == HALF_OPEN {
+		b.probing = false
+	}
+}
+
+// open switches to OPEN, mu must be held
+func (b *Breaker) open() {
+	b.openedAt = time.Now()
+	b.setState(OPEN)
+}
+
+// setState changes the state and reports it, mu must be held
+func (b *Breaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(b.name, state)
+	}
+}
+
+// RetryAfter returns the shortest wait of the open breakers in err, which may join several errors,
+// ok is false when no breaker rejected the call
+func RetryAfter(err error) (time.Duration, bool) {
+	var openErr *OpenError
+	switch e := err.(type) {
+	case nil:
+		return 0, false
+	case interface{ Unwrap() []error }:
+		var shortest time.Duration
+		found := false
+		for _, inner := range e.Unwrap() {
+			if wait, ok := RetryAfter(inner); ok && (!found || wait < shortest) {
+				shortest, found = wait, true
+			}
+		}
+		return shortest, found
+	default:
+		if errors.As(err, &openErr) {
+			return openErr.RetryAfter, true
+		}
+		return 0, false
+	}
+}
@@ -0,0 +1,137 @@
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var errFailed = errors.New("failed")
+
+func TestBreakerOpens(t *testing.T) {
+	config := Config{Window: time.Minute, MinRequests: 4, FailureRatio: 0.5, OpenFor: time.Minute}
+
+	tests := []struct {
+		name     string
+		outcomes []error
+		want     string
+	}{
+		{"no calls", nil, CLOSED},
+		{"successes", []error{nil, nil, nil, nil, nil}, CLOSED},
+		{"failures below min requests", []error{errFailed, errFailed, errFailed}, CLOSED},
+		{"failures below ratio", []error{nil, errFailed, nil, nil}, CLOSED},
+		{"failures at ratio", []error{nil, errFailed, nil, errFailed}, OPEN},
+		{"failures only", []error{errFailed, errFailed, errFailed, errFailed}, OPEN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New("test", config, nil)
+			for _, err := range tt.outcomes {
+				if allowErr := b.Allow(); allowErr != nil {
+					t.Fatalf("Allow() = %v, want nil", allowErr)
+				}
+				b.Record(err)
+			}
+			if got := b.State(); got != tt.want {
+				t.Errorf("State() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerWindowResets(t *testing.T) {
+	b := New("test", Config{Window: 20 * time.Millisecond, MinRequests: 2, FailureRatio: 0.5, OpenFor: time.Minute}, nil)
+	b.Allow()
+	b.Record(errFailed)
+	time.Sleep(30 * time.Millisecond)
+
+	b.Allow()
+	b.Record(nil)
+	if got := b.State(); got != CLOSED {
+		t.Errorf("State() = %s, want %s: the failure of the last window still counted", got, CLOSED)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	config := Config{Window: time.Minute, MinRequests: 1, FailureRatio: 0.5, OpenFor: 20 * time.Millisecond}
+
+	tests := []struct {
+		name  string
+		trial error
+		want  string
+	}{
+		{"trial succeeds", nil, CLOSED},
+		{"trial fails", errFailed, OPEN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var states []string
+			b := New("test", config, func(name string, state string) { states = append(states, state) })
+			b.Allow()
+			b.Record(errFailed)
+
+			var openErr *OpenError
+			if err := b.Allow(); !errors.As(err, &openErr) || !errors.Is(err, ErrOpen) {
+				t.Fatalf("Allow() while open = %v, want an *OpenError", err)
+			}
+			time.Sleep(30 * time.Millisecond)
+
+			if err := b.Allow(); err != nil {
+				t.Fatalf("Allow() after OpenFor = %v, want the trial call", err)
+			}
+			if err := b.Allow(); !errors.As(err, &openErr) {
+				t.Fatalf("Allow() during the trial call = %v, want an *OpenError", err)
+			}
+			b.Record(tt.trial)
+			if got := b.State(); got != tt.want {
+				t.Errorf("State() = %s, want %s", got, tt.want)
+			}
+			want := []string{CLOSED, OPEN, HALF_OPEN, tt.want}
+			if fmt.Sprint(states) != fmt.Sprint(want) {
+				t.Errorf("state changes = %v, want %v", states, want)
+			}
+		})
+	}
+}
+
+func TestBreakerAbandon(t *testing.T) {
+	b := New("test", Config{Window: time.Minute, MinRequests: 1, FailureRatio: 0.5, OpenFor: 20 * time.Millisecond}, nil)
+	b.Allow()
+	b.Record(errFailed)
+	time.Sleep(30 * time.Millisecond)
+
+	b.Allow()
+	b.Abandon()
+	if err := b.Allow(); err != nil {
+		t.Errorf("Allow() after an abandoned trial = %v, want a new trial call", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		want   time.Duration
+		wantOK bool
+	}{
+		{"nil", nil, 0, false},
+		{"other error", errFailed, 0, false},
+		{"open", &OpenError{RetryAfter: time.Second}, time.Second, true},
+		{"wrapped", fmt.Errorf("sms : %w", &OpenError{RetryAfter: time.Second}), time.Second, true},
+		{"joined takes the shortest", errors.Join(
+			&OpenError{RetryAfter: 3 * time.Second},
+			errFailed,
+			fmt.Errorf("b : %w", &OpenError{RetryAfter: 2 * time.Second}),
+		), 2 * time.Second, true},
+		{"joined without open breakers", errors.Join(errFailed, errFailed), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := RetryAfter(tt.err)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("RetryAfter() = %s, %t, want %s, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
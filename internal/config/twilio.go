@@ -1,21 +1,38 @@
 package config
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
 	"github.com/pi-prakhar/utils/loader"
 	"github.com/twilio/twilio-go"
+	"github.com/twilio/twilio-go/client"
 )
 
 func GetTwilioClient() *twilio.RestClient {
 	username := getAccountSID()
 	password := getAuthToken()
 
-	client := twilio.NewRestClientWithParams(twilio.ClientParams{
-		Username: username,
-		Password: password,
+	httpClient := &client.Client{
+		Credentials: client.NewCredentials(username, password),
+	}
+	httpClient.SetAccountSid(username)
+	httpClient.SetTimeout(getTimeout())
+
+	return twilio.NewRestClientWithParams(twilio.ClientParams{
+		Client: httpClient,
 	})
+}
 
-	return client
+// getTimeout bounds every twilio http call, defaults to 10 seconds like twilio-go
+func getTimeout() time.Duration {
+	timeout, err := utils.GetSecondsFromConf("twilio-timeout", 10*time.Second)
+	if err != nil {
+		utils.Log.Warn("Failed to load twilio-timeout from conf, using 10 seconds")
+	}
+	return timeout
 }
 
 func getAccountSID() string {
@@ -41,3 +58,49 @@ func GetTwilioPhoneNumber() string {
 	}
 	return phone_number
 }
+
+func GetTwilioServiceID() string {
+	service_id, err := loader.GetValueFromEnv("TWILIO_SERVICES_ID")
+	if err != nil {
+		utils.Log.Error("Error fetching twilio services_id", err)
+	}
+	return service_id
+}
+
+// GetTwilioWhatsAppConfig returns the whatsapp sender number and authentication template SID,
+// ok is false when either is not set and the whatsapp channel should stay disabled
+func GetTwilioWhatsAppConfig() (string, string, bool) {
+	phone_number, err := loader.GetValueFromEnv("TWILIO_WHATSAPP_NUMBER")
+	if err != nil || phone_number == "" {
+		return "", "", false
+	}
+	template_sid, err := loader.GetValueFromEnv("TWILIO_WHATSAPP_TEMPLATE_SID")
+	if err != nil || template_sid == "" {
+		return "", "", false
+	}
+	return phone_number, template_sid, true
+}
+
+// GetTwilioAuthToken returns the auth token webhook signatures are checked with, ok is false when it is not set
+func GetTwilioAuthToken() (string, bool) {
+	auth_token, err := loader.GetValueFromEnv("TWILIO_AUTHTOKEN")
+	if err != nil || auth_token == "" {
+		return "", false
+	}
+	return auth_token, true
+}
+
+// CheckTwilioCredentials reports which twilio env values are missing, without exiting like the getters above,
+// extra lists env keys needed on top of the account credentials
+func CheckTwilioCredentials(extra ...string) error {
+	var missing []string
+	for _, key := range append([]string{"TWILIO_ACCOUNT_SID", "TWILIO_AUTHTOKEN", "TWILIO_PHONE_NUMBER"}, extra...) {
+		if value, err := loader.GetValueFromEnv(key); err != nil || value == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("twilio credentials not configured : %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -1,31 +1,243 @@
 package database
 
 import (
-	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
 	"github.com/pi-prakhar/utils/loader"
 )
 
-var Ctx = context.Background()
+var ErrNotInitialized = errors.New("redis client is not initialized")
 
-func Client(dbNo int) *redis.Client {
-	address, err := loader.GetValueFromConf("redis-db-address")
+var (
+	mu     sync.Mutex
+	client redis.UniversalClient
+)
+
+const (
+	STANDALONE = "standalone"
+	SENTINEL   = "sentinel"
+	CLUSTER    = "cluster"
+)
+
+// Init builds the shared redis client from conf, calling it again reuses the existing client
+func Init() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if client != nil {
+		return nil
+	}
+
+	mode, err := utils.GetStringFromConf("redis-mode", STANDALONE)
+	if err != nil {
+		return err
+	}
+	options, err := loadOptions()
 	if err != nil {
-		utils.Log.Error("Failed to get value from conf", err)
+		utils.Log.Debug("Error : Failed to load redis options from conf")
+		return err
+	}
+
+	switch mode {
+	case STANDALONE:
+		client = redis.NewClient(options)
+	case SENTINEL:
+		failoverOptions, err := loadFailoverOptions(options)
+		if err != nil {
+			utils.Log.Debug("Error : Failed to load redis sentinel options from conf")
+			return err
+		}
+		client = redis.NewFailoverClient(failoverOptions)
+	case CLUSTER:
+		clusterOptions, err := loadClusterOptions(options)
+		if err != nil {
+			utils.Log.Debug("Error : Failed to load redis cluster options from conf")
+			return err
+		}
+		client = redis.NewClusterClient(clusterOptions)
+	default:
+		return fmt.Errorf("unknown redis-mode '%s'", mode)
+	}
+	utils.Log.Info(fmt.Sprintf("Successfully created shared redis client in %s mode", mode))
+	return nil
+}
+
+// Client returns the shared redis client, nil until Init is called
+func Client() redis.UniversalClient {
+	mu.Lock()
+	defer mu.Unlock()
+	return client
+}
+
+// Close closes the shared client and its connection pool
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if client == nil {
+		return nil
+	}
+	err := client.Close()
+	client = nil
+	if err != nil {
+		utils.Log.Debug("Error : Failed to close redis client")
+		return err
+	}
+	utils.Log.Info("Successfully closed redis client")
+	return nil
+}
+
+// PoolStats returns the connection pool stats of the shared client
+func PoolStats() (*redis.PoolStats, error) {
+	rdb := Client()
+	if rdb == nil {
+		return nil, ErrNotInitialized
+	}
+	return rdb.PoolStats(), nil
+}
+
+// loadOptions loads the settings shared by every mode, Addr is only used in standalone mode
+func loadOptions() (*redis.Options, error) {
+	address, err := utils.GetStringFromConf("redis-db-address", "")
+	if err != nil {
+		return nil, err
 	}
 
 	password, err := loader.GetValueFromEnv("REDIS_DB_PASSWORD")
 	if err != nil {
-		utils.Log.Error("Failed to get value from env", err)
+		utils.Log.Debug("REDIS_DB_PASSWORD not set, connecting without password")
+	}
+
+	db, err := utils.GetIntFromConf("redis-db", 0)
+	if err != nil {
+		return nil, err
+	}
+	// 0 lets go-redis pick its default of 10 connections per CPU
+	poolSize, err := utils.GetIntFromConf("redis-pool-size", 0)
+	if err != nil {
+		return nil, err
+	}
+	minIdleConns, err := utils.GetIntFromConf("redis-min-idle-conns", 0)
+	if err != nil {
+		return nil, err
+	}
+	dialTimeout, err := utils.GetSecondsFromConf("redis-dial-timeout", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	readTimeout, err := utils.GetSecondsFromConf("redis-read-timeout", 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	writeTimeout, err := utils.GetSecondsFromConf("redis-write-timeout", 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		return nil, err
 	}
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     address,
-		Password: password,
-		DB:       dbNo,
-	})
+	return &redis.Options{
+		Addr:         address,
+		Password:     password,
+		DB:           db,
+		PoolSize:     poolSize,
+		MinIdleConns: minIdleConns,
+		DialTimeout:  dialTimeout,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		TLSConfig:    tlsConfig,
+	}, nil
+}
 
-	return rdb
+func loadFailoverOptions(options *redis.Options) (*redis.FailoverOptions, error) {
+	masterName, err := loader.GetValueFromConf("redis-sentinel-master-name")
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := loadAddresses("redis-sentinel-addresses")
+	if err != nil {
+		return nil, err
+	}
+	sentinelPassword, err := loader.GetValueFromEnv("REDIS_SENTINEL_PASSWORD")
+	if err != nil {
+		utils.Log.Debug("REDIS_SENTINEL_PASSWORD not set, connecting to sentinels without password")
+	}
+
+	return &redis.FailoverOptions{
+		MasterName:       masterName,
+		SentinelAddrs:    addresses,
+		SentinelPassword: sentinelPassword,
+		Password:         options.Password,
+		DB:               options.DB,
+		PoolSize:         options.PoolSize,
+		MinIdleConns:     options.MinIdleConns,
+		DialTimeout:      options.DialTimeout,
+		ReadTimeout:      options.ReadTimeout,
+		WriteTimeout:     options.WriteTimeout,
+		TLSConfig:        options.TLSConfig,
+	}, nil
+}
+
+func loadClusterOptions(options *redis.Options) (*redis.ClusterOptions, error) {
+	addresses, err := loadAddresses("redis-cluster-addresses")
+	if err != nil {
+		return nil, err
+	}
+	if options.DB != 0 {
+		return nil, errors.New("redis-db must be 0 in cluster mode")
+	}
+
+	return &redis.ClusterOptions{
+		Addrs:        addresses,
+		Password:     options.Password,
+		PoolSize:     options.PoolSize,
+		MinIdleConns: options.MinIdleConns,
+		DialTimeout:  options.DialTimeout,
+		ReadTimeout:  options.ReadTimeout,
+		WriteTimeout: options.WriteTimeout,
+		TLSConfig:    options.TLSConfig,
+	}, nil
+}
+
+// loadAddresses reads a comma separated list of host:port from conf
+func loadAddresses(key string) ([]string, error) {
+	value, err := loader.GetValueFromConf(key)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("%s in conf has no addresses", key)
+	}
+	return addresses, nil
+}
+
+// loadTLSConfig returns nil when redis-tls is off
+func loadTLSConfig() (*tls.Config, error) {
+	enabled, err := utils.GetBoolFromConf("redis-tls", false)
+	if err != nil || !enabled {
+		return nil, err
+	}
+	skipVerify, err := utils.GetBoolFromConf("redis-tls-insecure-skip-verify", false)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: skipVerify,
+	}, nil
 }
@@ -0,0 +1,184 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/database"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+var ErrNotFound = errors.New("dead letter not found")
+
+// Entry is a code that did not reach the user, a send the provider did not accept after every retry
+// and fallback or a send job that could not be delivered. The code itself is never kept, a replay
+// issues a new one. JobID and Deliveries are set for send jobs, a job that could not be decoded has
+// no destination
+type Entry struct {
+	ID          string    `json:"id"`
+	Destination string    `json:"destination"`
+	Channel     string    `json:"channel"`
+	Language    string    `json:"language,omitempty"`
+	Error       string    `json:"error"`
+	ErrorCode   string    `json:"errorCode"`
+	Attempts    int       `json:"attempts"`
+	JobID       string    `json:"jobId,omitempty"`
+	Deliveries  int64     `json:"deliveries,omitempty"`
+	FailedAt    time.Time `json:"failedAt"`
+}
+
+// Filter selects entries, zero fields match everything
+type Filter struct {
+	Since     time.Time
+	Until     time.Time
+	ErrorCode string
+	Channel   string
+	Limit     int
+}
+
+func (f Filter) matches(entry Entry) bool {
+	return (f.ErrorCode == "" || f.ErrorCode == entry.ErrorCode) && (f.Channel == "" || f.Channel == entry.Channel)
+}
+
+// Store keeps the entries on a redis stream, stream IDs start with the time in milliseconds
+// so time ranges are read without scanning the whole stream. Entries hold phone numbers and
+// emails, so they are dropped once they are older than retention
+type Store struct {
+	rdb       redis.UniversalClient
+	stream    string
+	retention time.Duration
+}
+
+func NewStore(rdb redis.UniversalClient, stream string, retention time.Duration) *Store {
+	return &Store{rdb: rdb, stream: stream, retention: retention}
+}
+
+// New builds the store on the shared redis client from "queue-dead-letter-stream", the stream the
+// send queue moves undeliverable jobs to, and "dead-letter-retention"
+func New() (*Store, error) {
+	rdb := database.Client()
+	if rdb == nil {
+		return nil, fmt.Errorf("the dead-letter store needs otp-store redis : %w", database.ErrNotInitialized)
+	}
+	stream, err := utils.GetStringFromConf("queue-dead-letter-stream", "otp:send:dead")
+	if err != nil {
+		return nil, err
+	}
+	retention, err := utils.GetSecondsFromConf("dead-letter-retention", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(rdb, stream, retention), nil
+}
+
+// Retention is how long entries are kept
+func (s *Store) Retention() time.Duration {
+	return s.retention
+}
+
+// minID is the oldest stream ID still within retention
+func (s *Store) minID() string {
+	return strconv.FormatInt(time.Now().Add(-s.retention).UnixMilli(), 10)
+}
+
+// Add records entry and returns its ID, the ID of entry is ignored. Entries past retention are
+// trimmed on the way
+func (s *Store) Add(ctx context.Context, entry Entry) (string, error) {
+	entry.ID = ""
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	return s.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.stream,
+		MinID:  s.minID(),
+		Approx: true,
+		Values: map[string]any{"entry": string(value)},
+	}).Result()
+}
+
+// trim drops the entries past retention, Add trims approximately and a quiet stream is not added to
+func (s *Store) trim(ctx context.Context) error {
+	return s.rdb.XTrimMinID(ctx, s.stream, s.minID()).Err()
+}
+
+// List returns the entries matching filter, oldest first
+func (s *Store) List(ctx context.Context, filter Filter) ([]Entry, error) {
+	if err := s.trim(ctx); err != nil {
+		return nil, err
+	}
+	start, end := "-", "+"
+	if !filter.Since.IsZero() {
+		start = strconv.FormatInt(filter.Since.UnixMilli(), 10)
+	}
+	if !filter.Until.IsZero() {
+		end = strconv.FormatInt(filter.Until.UnixMilli(), 10)
+	}
+
+	entries := []Entry{}
+	//read in pages so the code and channel filters do not load the whole stream at once
+	for {
+		messages, err := s.rdb.XRangeN(ctx, s.stream, start, end, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			entry, err := decode(message)
+			if err != nil {
+				utils.Log.Warn(err.Error())
+				continue
+			}
+			if filter.matches(entry) {
+				entries = append(entries, entry)
+				if filter.Limit > 0 && len(entries) >= filter.Limit {
+					return entries, nil
+				}
+			}
+		}
+		if len(messages) < 100 {
+			return entries, nil
+		}
+		start = "(" + messages[len(messages)-1].ID
+	}
+}
+
+// Get returns the entry with id, ErrNotFound when there is none
+func (s *Store) Get(ctx context.Context, id string) (Entry, error) {
+	if err := s.trim(ctx); err != nil {
+		return Entry{}, err
+	}
+	messages, err := s.rdb.XRange(ctx, s.stream, id, id).Result()
+	if err != nil {
+		return Entry{}, err
+	}
+	if len(messages) == 0 {
+		return Entry{}, fmt.Errorf("%w : %s", ErrNotFound, id)
+	}
+	return decode(messages[0])
+}
+
+// Delete removes the entries and returns how many existed
+func (s *Store) Delete(ctx context.Context, ids ...string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return s.rdb.XDel(ctx, s.stream, ids...).Result()
+}
+
+func decode(message redis.XMessage) (Entry, error) {
+	raw, ok := message.Values["entry"].(string)
+	if !ok {
+		return Entry{}, fmt.Errorf("dead letter %s has no entry", message.ID)
+	}
+	var entry Entry
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		return Entry{}, fmt.Errorf("dead letter %s is invalid : %w", message.ID, err)
+	}
+	entry.ID = message.ID
+	return entry, nil
+}
@@ -0,0 +1,135 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	UP   = "up"
+	DOWN = "down"
+)
+
+// Check is one dependency probe, Run must return once ctx is done
+type Check struct {
+	Name string
+	// Liveness checks also run for the liveness probe, keep them to process local state
+	Liveness bool
+	Run      func(ctx context.Context) error
+}
+
+// Result is the outcome of the last run of a check
+type Result struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	LatencyMs float64   `json:"latencyMs"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Checker runs checks with a timeout each and caches their results so frequent probes
+// do not hammer the dependencies
+type Checker struct {
+	checks   []Check
+	timeout  time.Duration
+	cacheTTL time.Duration
+
+	mu     sync.Mutex
+	cached map[string]Result
+}
+
+func NewChecker(timeout time.Duration, cacheTTL time.Duration, checks ...Check) *Checker {
+	return &Checker{
+		checks:   checks,
+		timeout:  timeout,
+		cacheTTL: cacheTTL,
+		cached:   make(map[string]Result),
+	}
+}
+
+// Liveness runs the checks marked as liveness checks
+func (c *Checker) Liveness(ctx context.Context) ([]Result, bool) {
+	var checks []Check
+	for _, check := range c.checks {
+		if check.Liveness {
+			checks = append(checks, check)
+		}
+	}
+	return c.run(ctx, checks)
+}
+
+// Readiness runs every check
+func (c *Checker) Readiness(ctx context.Context) ([]Result, bool) {
+	return c.run(ctx, c.checks)
+}
+
+// run returns the results in check order and whether all of them are up
+func (c *Checker) run(ctx context.Context, checks []Check) ([]Result, bool) {
+	results := make([]Result, len(checks))
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		if result, ok := c.fromCache(check.Name); ok {
+			results[i] = result
+			continue
+		}
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = c.runCheck(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	healthy := true
+	for _, result := range results {
+		if result.Status != UP {
+			healthy = false
+		}
+	}
+	return results, healthy
+}
+
+func (c *Checker) fromCache(name string) (Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result, ok := c.cached[name]
+	if !ok || time.Since(result.CheckedAt) > c.cacheTTL {
+		return Result{}, false
+	}
+	return result, true
+}
+
+func (c *Checker) runCheck(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check.Run(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	result := Result{
+		Name:      check.Name,
+		Status:    UP,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		CheckedAt: time.Now(),
+	}
+	if err != nil {
+		result.Status = DOWN
+		result.Error = err.Error()
+	}
+
+	c.mu.Lock()
+	c.cached[check.Name] = result
+	c.mu.Unlock()
+	return result
+}
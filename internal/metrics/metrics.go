@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/response"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "otp"
+
+const (
+	SUCCESS = "success"
+	ERROR   = "error"
+)
+
+var (
+	Sends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sends_total",
+		Help:      "OTP send attempts by outcome.",
+	}, []string{"outcome"})
+
+	VerifyOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "verify_outcomes_total",
+		Help:      "OTP verifications by outcome: verified, incorrect, expired, max_limit_lock or locked.",
+	}, []string{"outcome"})
+
+	LockHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lock_hits_total",
+		Help:      "Requests rejected because the phone number is locked.",
+	}, []string{"operation"})
+
+	ProviderErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provider_errors_total",
+		Help:      "Errors returned by the message provider.",
+	}, []string{"provider", "code"})
+
+	MessageStatuses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "message_statuses_total",
+		Help:      "Message statuses reported by twilio status callbacks.",
+	}, []string{"status", "code"})
+
+	Fallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "channel_fallbacks_total",
+		Help:      "Codes re-sent on the next channel by trigger (status_callback or timeout), channel and outcome.",
+	}, []string{"trigger", "channel", "outcome"})
+
+	LimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "limit_rejections_total",
+		Help:      "Requests refused by a send or code limit, locked is true when the limit lock was in place.",
+	}, []string{"limit", "locked"})
+
+	Resends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "resends_total",
+		Help:      "Resend requests by channel and outcome (sent, too_soon, limit, no_code or error).",
+	}, []string{"channel", "outcome"})
+
+	ProviderRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provider_retries_total",
+		Help:      "Sends retried after a retryable provider error.",
+	}, []string{"provider"})
+
+	ProviderFailovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "provider_failovers_total",
+		Help:      "SMS sends moved on to the next provider after this provider failed.",
+	}, []string{"provider"})
+
+	BreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "provider_breaker_state",
+		Help:      "Circuit breaker state per provider, 1 for the current state: closed, open or half_open.",
+	}, []string{"provider", "state"})
+
+	QueueJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_jobs_total",
+		Help:      "Async send jobs by outcome: enqueued, sent, retried, skipped or dead_lettered.",
+	}, []string{"outcome"})
+
+	QueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "queue_wait_seconds",
+		Help:      "Time from enqueueing an async send job to its successful delivery.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	})
+
+	HandlerLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP handler latency by route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "outcome"})
+
+	StoreLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "store_operation_duration_seconds",
+		Help:      "Redis (or memory store) operation latency.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation", "outcome"})
+
+	ProviderLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "provider_request_duration_seconds",
+		Help:      "Message provider API latency, e.g. twilio CreateMessage.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"provider", "operation", "outcome"})
+)
+
+// Outcome returns the SUCCESS or ERROR label for err
+func Outcome(err error) string {
+	if err != nil {
+		return ERROR
+	}
+	return SUCCESS
+}
+
+// Since returns the seconds elapsed since start, for Observe
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records handler latency labelled by the mux route template and response status
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := response.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		HandlerLatency.WithLabelValues(route, strconv.Itoa(recorder.Status)).Observe(Since(start))
+	})
+}
@@ -0,0 +1,283 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/database"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+// Job is one OTP delivery to make, the code itself stays in the otp store. A job with a Trigger is a
+// fallback scheduled after delivery attempt Attempt instead of the first delivery of the code
+type Job struct {
+	VerificationID string    `json:"verificationId"`
+	Identifier     string    `json:"identifier"`
+	Destination    string    `json:"destination,omitempty"`
+	Channel        string    `json:"channel,omitempty"`
+	Language       string    `json:"language,omitempty"`
+	Trigger        string    `json:"trigger,omitempty"`
+	Attempt        int       `json:"attempt,omitempty"`
+	EnqueuedAt     time.Time `json:"enqueuedAt"`
+	// Limits are the rate limit events the code was counted as, given back when it is not sent
+	Limits []LimitHit `json:"limits,omitempty"`
+}
+
+// LimitHit is one event counted in the rolling window at Key
+type LimitHit struct {
+	Key string `json:"key"`
+	ID  string `json:"id"`
+}
+
+// Message is a job read from the stream. Deliveries counts how often it was handed to a consumer,
+// a message that can not be decoded has a nil Job and DecodeErr set
+type Message struct {
+	ID         string
+	Job        *Job
+	Deliveries int64
+	DecodeErr  error
+}
+
+// Config names the stream and decides how often a job is tried, jobs that can not be delivered are
+// recorded as dead letters by the caller
+type Config struct {
+	Stream string
+	Group  string
+	// DelayedSet holds scheduled jobs until they are due
+	DelayedSet string
+	// MaxDeliveries is how often a job is handed out before it is dead-lettered
+	MaxDeliveries int64
+	// RetryAfter is how long a job stays unacknowledged before another consumer claims it
+	RetryAfter time.Duration
+	// MaxLen caps the stream length, older entries are trimmed
+	MaxLen int64
+}
+
+// GetConfig loads the queue settings from conf
+func GetConfig() (Config, error) {
+	config := Config{}
+	var err error
+	if config.Stream, err = utils.GetStringFromConf("queue-stream", "otp:send"); err != nil {
+		return config, err
+	}
+	if config.Group, err = utils.GetStringFromConf("queue-group", "otp-workers"); err != nil {
+		return config, err
+	}
+	if config.DelayedSet, err = utils.GetStringFromConf("queue-delayed-set", "otp:send:delayed"); err != nil {
+		return config, err
+	}
+	maxDeliveries, err := utils.GetIntFromConf("queue-max-deliveries", 3)
+	if err != nil {
+		return config, err
+	}
+	if config.RetryAfter, err = utils.GetSecondsFromConf("queue-retry-after", 5*time.Second); err != nil {
+		return config, err
+	}
+	maxLen, err := utils.GetIntFromConf("queue-max-len", 100000)
+	if err != nil {
+		return config, err
+	}
+	config.MaxDeliveries = int64(max(1, maxDeliveries))
+	config.MaxLen = int64(maxLen)
+	return config, nil
+}
+
+// StreamQueue is a job queue on a redis stream read through a consumer group, so every job goes to one
+// consumer and stays pending until it is acknowledged
+type StreamQueue struct {
+	rdb    redis.UniversalClient
+	config Config
+}
+
+func NewStreamQueue(rdb redis.UniversalClient, config Config) *StreamQueue {
+	return &StreamQueue{rdb: rdb, config: config}
+}
+
+func (q *StreamQueue) Config() Config {
+	return q.config
+}
+
+// Enqueue adds job to the stream and returns its stream ID
+func (q *StreamQueue) Enqueue(ctx context.Context, job Job) (string, error) {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+	return q.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: q.config.Stream,
+		MaxLen: q.config.MaxLen,
+		Approx: true,
+		Values: map[string]any{"job": string(value)},
+	}).Result()
+}
+
+// Schedule keeps job in the delayed set until at, PromoteDue moves it to the stream once it is due
+func (q *StreamQueue) Schedule(ctx context.Context, job Job, at time.Time) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.rdb.ZAdd(ctx, q.config.DelayedSet, &redis.Z{Score: float64(at.UnixMilli()), Member: string(value)}).Err()
+}
+
+// PromoteDue moves up to count scheduled jobs that are due to the stream and returns how many it moved.
+// Removing a job from the delayed set claims it, so every job is moved by one caller only
+func (q *StreamQueue) PromoteDue(ctx context.Context, count int64) (int, error) {
+	due, err := q.rdb.ZRangeByScore(ctx, q.config.DelayedSet, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Count: count,
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+	promoted := 0
+	for _, value := range due {
+		removed, err := q.rdb.ZRem(ctx, q.config.DelayedSet, value).Result()
+		if err != nil {
+			return promoted, err
+		}
+		if removed == 0 {
+			continue
+		}
+		if err := q.rdb.XAdd(ctx, &redis.XAddArgs{
+			Stream: q.config.Stream,
+			MaxLen: q.config.MaxLen,
+			Approx: true,
+			Values: map[string]any{"job": value},
+		}).Err(); err != nil {
+			//put the job back so it is not lost
+			q.rdb.ZAdd(ctx, q.config.DelayedSet, &redis.Z{Score: float64(time.Now().UnixMilli()), Member: value})
+			return promoted, err
+		}
+		promoted++
+	}
+	return promoted, nil
+}
+
+// CreateGroup creates the consumer group, and the stream when missing. The group starts at the
+// beginning of the stream so jobs enqueued before the first worker started are not lost
+func (q *StreamQueue) CreateGroup(ctx context.Context) error {
+	err := q.rdb.XGroupCreateMkStream(ctx, q.config.Stream, q.config.Group, "0").Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// Read waits up to block for new jobs and hands them to consumer
+func (q *StreamQueue) Read(ctx context.Context, consumer string, count int64, block time.Duration) ([]Message, error) {
+	streams, err := q.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    q.config.Group,
+		Consumer: consumer,
+		Streams:  []string{q.config.Stream, ">"},
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	for _, stream := range streams {
+		for _, entry := range stream.Messages {
+			messages = append(messages, decode(entry, 1))
+		}
+	}
+	return messages, nil
+}
+
+// Claim hands jobs that stayed unacknowledged for RetryAfter, because their send failed or their
+// consumer died, to consumer
+func (q *StreamQueue) Claim(ctx context.Context, consumer string, count int64) ([]Message, error) {
+	pending, err := q.rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: q.config.Stream,
+		Group:  q.config.Group,
+		Idle:   q.config.RetryAfter,
+		Start:  "-",
+		End:    "+",
+		Count:  count,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+	deliveries := make(map[string]int64, len(pending))
+	ids := make([]string, 0, len(pending))
+	for _, p := range pending {
+		deliveries[p.ID] = p.RetryCount
+		ids = append(ids, p.ID)
+	}
+
+	entries, err := q.rdb.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   q.config.Stream,
+		Group:    q.config.Group,
+		Consumer: consumer,
+		MinIdle:  q.config.RetryAfter,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]Message, 0, len(entries))
+	for _, entry := range entries {
+		//claiming counts as one more delivery
+		messages = append(messages, decode(entry, deliveries[entry.ID]+1))
+	}
+	return messages, nil
+}
+
+// Ack marks the job done
+func (q *StreamQueue) Ack(ctx context.Context, id string) error {
+	return q.rdb.XAck(ctx, q.config.Stream, q.config.Group, id).Err()
+}
+
+func decode(entry redis.XMessage, deliveries int64) Message {
+	message := Message{ID: entry.ID, Deliveries: deliveries}
+	raw, ok := entry.Values["job"].(string)
+	if !ok {
+		message.DecodeErr = fmt.Errorf("stream entry %s has no job", entry.ID)
+		return message
+	}
+	var job Job
+	if err := json.Unmarshal([]byte(raw), &job); err != nil {
+		message.DecodeErr = fmt.Errorf("stream entry %s has an invalid job : %w", entry.ID, err)
+		return message
+	}
+	message.Job = &job
+	return message
+}
+
+// New builds the send queue on the shared redis client, so the otp store must be redis
+func New() (*StreamQueue, error) {
+	rdb := database.Client()
+	if rdb == nil {
+		return nil, fmt.Errorf("the send queue needs otp-store redis : %w", database.ErrNotInitialized)
+	}
+	config, err := GetConfig()
+	if err != nil {
+		utils.Log.Debug("Error : Failed to load queue settings from conf")
+		return nil, err
+	}
+	return NewStreamQueue(rdb, config), nil
+}
+
+// ConsumerName names the consumers of this process, unique per host and process
+func ConsumerName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "worker"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
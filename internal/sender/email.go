@@ -0,0 +1,255 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/tracing"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// EMAIL delivers the code to an email address
+const EMAIL = "email"
+
+const SMTP = "smtp"
+
+// EmailContent is what the email templates are rendered with
+type EmailContent struct {
+	To       string
+	Code     string
+	Language string
+}
+
+// SMTPSender sends the OTP by email through an SMTP server, as a text and an html alternative
+type SMTPSender struct {
+	host    string
+	addr    string
+	from    *mail.Address
+	subject string
+	auth    smtp.Auth
+	timeout time.Duration
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// NewSMTPSender builds the sender from the smtp-* keys in conf and the otp.txt and otp.html
+// templates in "email-template-dir". SMTP_USERNAME and SMTP_PASSWORD in env enable auth
+func NewSMTPSender() (*SMTPSender, error) {
+	host, err := utils.GetStringFromConf("smtp-host", "")
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		return nil, fmt.Errorf("smtp-host not set in conf")
+	}
+	port, err := utils.GetIntFromConf("smtp-port", 25)
+	if err != nil {
+		return nil, err
+	}
+	fromConf, err := utils.GetStringFromConf("smtp-from", "")
+	if err != nil {
+		return nil, err
+	}
+	from, err := mail.ParseAddress(fromConf)
+	if err != nil {
+		utils.Log.Debug("Error : smtp-from in conf is not an email address")
+		return nil, err
+	}
+	subject, err := utils.GetStringFromConf("smtp-subject", "Your verification code")
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := utils.GetSecondsFromConf("smtp-timeout", time.Second*10)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := utils.GetStringFromConf("email-template-dir", "templates/email")
+	if err != nil {
+		return nil, err
+	}
+	text, err := texttemplate.ParseFiles(filepath.Join(dir, "otp.txt"))
+	if err != nil {
+		utils.Log.Debug("Error : Failed to parse email text template")
+		return nil, err
+	}
+	html, err := htmltemplate.ParseFiles(filepath.Join(dir, "otp.html"))
+	if err != nil {
+		utils.Log.Debug("Error : Failed to parse email html template")
+		return nil, err
+	}
+
+	s := &SMTPSender{
+		host:    host,
+		addr:    net.JoinHostPort(host, fmt.Sprint(port)),
+		from:    from,
+		subject: subject,
+		timeout: timeout,
+		text:    text,
+		html:    html,
+	}
+	//net/smtp refuses plain auth over an unencrypted connection to anything but localhost
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		s.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return s, nil
+}
+
+func (s *SMTPSender) Send(ctx context.Context, message Message) (Result, error) {
+	ctx, span := tracing.Start(ctx, "smtp.SendMail", attribute.String("messaging.system", SMTP))
+	start := time.Now()
+	messageID, err := s.send(ctx, message)
+	if err != nil && ctx.Err() != nil {
+		//report the cancellation rather than the i/o error it caused
+		err = ctx.Err()
+	}
+	metrics.ProviderLatency.WithLabelValues(SMTP, "send_mail", metrics.Outcome(err)).Observe(metrics.Since(start))
+	tracing.End(span, err)
+	if err != nil {
+		metrics.ProviderErrors.WithLabelValues(SMTP, smtpErrorCode(err)).Inc()
+		utils.Log.Debug("Error : Failed to send OTP email")
+		return Result{}, err
+	}
+	utils.Log.Debug("Successfully send OTP email")
+	return Result{MessageID: messageID, Status: "sent"}, nil
+}
+
+func (s *SMTPSender) send(ctx context.Context, message Message) (string, error) {
+	to, err := mail.ParseAddress(message.To)
+	if err != nil {
+		return "", err
+	}
+	messageID := fmt.Sprintf("<otp-%s@%s>", utils.CreateOTPString(16), s.host)
+	body, err := s.render(message, to, messageID)
+	if err != nil {
+		return "", err
+	}
+
+	dialer := net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return "", err
+	}
+	deadline := time.Now().Add(s.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	//unblock the conversation as soon as the request is canceled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return "", err
+		}
+	}
+	if s.auth != nil {
+		if err := c.Auth(s.auth); err != nil {
+			return "", err
+		}
+	}
+	if err := c.Mail(s.from.Address); err != nil {
+		return "", err
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return "", err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(body); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := c.Quit(); err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
+
+// render builds a multipart/alternative message with the text part first, so clients prefer the html one
+func (s *SMTPSender) render(message Message, to *mail.Address, messageID string) ([]byte, error) {
+	content := EmailContent{To: to.Address, Code: message.Code, Language: message.Language}
+
+	var buf bytes.Buffer
+	parts := multipart.NewWriter(&buf)
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	header("From", s.from.String())
+	header("To", to.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", s.subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", messageID)
+	header("MIME-Version", "1.0")
+	header("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%s", parts.Boundary()))
+	buf.WriteString("\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		execute     func(w *quotedprintable.Writer) error
+	}{
+		{"text/plain", func(w *quotedprintable.Writer) error { return s.text.Execute(w, content) }},
+		{"text/html", func(w *quotedprintable.Writer) error { return s.html.Execute(w, content) }},
+	} {
+		pw, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if err := part.execute(qp); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// smtpErrorCode returns the SMTP reply code as a metric label, or the kind of failure for other errors
+func smtpErrorCode(err error) string {
+	var protoErr *textproto.Error
+	var netErr net.Error
+	switch {
+	case errors.As(err, &protoErr):
+		return fmt.Sprint(protoErr.Code)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return errorCode(err)
+	}
+}
@@ -0,0 +1,271 @@
+package sender
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/breaker"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"github.com/twilio/twilio-go/client"
+)
+
+// RetryPolicy retries retryable provider errors with exponential backoff and full jitter:
+// retry n waits a random time up to min(MaxDelay, BaseDelay * 2^n)
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// GetRetryPolicy loads the retry policy from conf, 2 retries between 100ms and 1s by default
+func GetRetryPolicy() (RetryPolicy, error) {
+	policy := RetryPolicy{}
+	var err error
+	if policy.MaxRetries, err = utils.GetIntFromConf("sender-max-retries", 2); err != nil {
+		return policy, err
+	}
+	baseDelay, err := utils.GetIntFromConf("sender-retry-base-delay-ms", 100)
+	if err != nil {
+		return policy, err
+	}
+	maxDelay, err := utils.GetIntFromConf("sender-retry-max-delay-ms", 1000)
+	if err != nil {
+		return policy, err
+	}
+	policy.BaseDelay = time.Duration(baseDelay) * time.Millisecond
+	policy.MaxDelay = time.Duration(maxDelay) * time.Millisecond
+	return policy, nil
+}
+
+// backoff returns the wait before retry n, counting from 0
+func (p RetryPolicy) backoff(n int) time.Duration {
+	ceiling := p.BaseDelay << n
+	if ceiling <= 0 || ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// GetBreakerConfig loads the provider circuit breaker settings from conf, breaker.DefaultConfig by default
+func GetBreakerConfig() (breaker.Config, error) {
+	config := breaker.DefaultConfig
+	var err error
+	if config.Window, err = utils.GetSecondsFromConf("breaker-window", config.Window); err != nil {
+		return config, err
+	}
+	if config.MinRequests, err = utils.GetIntFromConf("breaker-min-requests", config.MinRequests); err != nil {
+		return config, err
+	}
+	if config.OpenFor, err = utils.GetSecondsFromConf("breaker-open-for", config.OpenFor); err != nil {
+		return config, err
+	}
+	percent, err := utils.GetIntFromConf("breaker-failure-percent", int(config.FailureRatio*100))
+	if err != nil {
+		return config, err
+	}
+	config.FailureRatio = float64(percent) / 100
+	return config, nil
+}
+
+// IsRetryable reports whether a provider error is transient and safe to send again: rate limits and 5xx
+// answers, and network failures before the request went out, i.e. dial errors and failed TLS handshakes.
+// Timeouts and broken connections after the request was written may have delivered the message, they
+// are not retried, nor are rejected requests, e.g. an invalid number, and canceled requests
+func IsRetryable(err error) bool {
+	var restErr *client.TwilioRestError
+	var providerErr *HTTPProviderError
+	var smtpErr *textproto.Error
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded), errors.Is(err, breaker.ErrOpen):
+		return false
+	case errors.As(err, &restErr):
+		return restErr.Status == 429 || restErr.Status >= 500
+	case errors.As(err, &providerErr):
+		return providerErr.StatusCode == 429 || providerErr.StatusCode >= 500
+	case errors.As(err, &smtpErr):
+		//4xx smtp replies are transient, 5xx permanent
+		return smtpErr.Code >= 400 && smtpErr.Code < 500
+	default:
+		return notSent(err)
+	}
+}
+
+// notSent reports whether a network error happened before any request was written
+func notSent(err error) bool {
+	var opErr *net.OpError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "dial", errors.Is(err, syscall.ECONNREFUSED):
+		return true
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr):
+		return true
+	default:
+		//net/http does not export its handshake timeout
+		return strings.Contains(err.Error(), "TLS handshake timeout")
+	}
+}
+
+// isProviderFailure reports whether err counts against the circuit breaker of the provider: retryable
+// errors and timeouts, which are not retried but still mean the provider is struggling. Send only
+// records it once the request itself did not give up
+func isProviderFailure(err error) bool {
+	var netErr net.Error
+	return IsRetryable(err) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// SendError is a send a provider failed after Attempts tries, zero when its breaker failed it fast
+type SendError struct {
+	Provider string
+	Attempts int
+	Err      error
+}
+
+func (e *SendError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Attempts returns how often the providers in err, which may join several errors, were tried.
+// Senders without retries count as one attempt
+func Attempts(err error) int {
+	var sendErr *SendError
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case interface{ Unwrap() []error }:
+		total := 0
+		for _, inner := range e.Unwrap() {
+			total += Attempts(inner)
+		}
+		return total
+	default:
+		if errors.As(err, &sendErr) {
+			return sendErr.Attempts
+		}
+		return 1
+	}
+}
+
+// ErrorCode returns the provider error code of a failed send: the twilio error code, the status of an
+// HTTP provider or the SMTP reply code, otherwise the kind of failure
+func ErrorCode(err error) string {
+	var providerErr *HTTPProviderError
+	var smtpErr *textproto.Error
+	switch {
+	case errors.Is(err, breaker.ErrOpen):
+		return "breaker_open"
+	case errors.Is(err, ErrUnsupportedChannel):
+		return "unsupported_channel"
+	case errors.As(err, &providerErr):
+		return fmt.Sprint(providerErr.StatusCode)
+	case errors.As(err, &smtpErr):
+		return fmt.Sprint(smtpErr.Code)
+	default:
+		return errorCode(err)
+	}
+}
+
+// GuardedSender wraps one provider with retries and a circuit breaker. While the breaker is open
+// sends fail fast with a *breaker.OpenError, only retryable errors and timeouts count as provider failures.
+// Failed sends return a *SendError with the number of attempts
+type GuardedSender struct {
+	name    string
+	next    Sender
+	policy  RetryPolicy
+	breaker *breaker.Breaker
+}
+
+func NewGuardedSender(name string, next Sender, policy RetryPolicy, config breaker.Config) *GuardedSender {
+	return &GuardedSender{
+		name:    name,
+		next:    next,
+		policy:  policy,
+		breaker: breaker.New(name, config, reportBreakerState),
+	}
+}
+
+// guard wraps s with the retry policy and breaker settings from conf
+func guard(name string, s Sender) (*GuardedSender, error) {
+	policy, err := GetRetryPolicy()
+	if err != nil {
+		return nil, err
+	}
+	config, err := GetBreakerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewGuardedSender(name, s, policy, config), nil
+}
+
+func (s *GuardedSender) Send(ctx context.Context, message Message) (Result, error) {
+	if err := s.breaker.Allow(); err != nil {
+		utils.Log.Debug(fmt.Sprintf("Circuit breaker of %s is open, failing fast", s.name))
+		return Result{}, &SendError{Provider: s.name, Err: err}
+	}
+
+	res, err := s.next.Send(ctx, message)
+	attempts := 1
+	for retry := 0; retry < s.policy.MaxRetries && IsRetryable(err); retry++ {
+		wait := s.policy.backoff(retry)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			break
+		}
+		utils.Log.Info(fmt.Sprintf("Retrying %s in %s after retryable error", s.name, wait.Round(time.Millisecond)))
+		metrics.ProviderRetries.WithLabelValues(s.name).Inc()
+		select {
+		case <-ctx.Done():
+			s.breaker.Abandon()
+			return Result{}, ctx.Err()
+		case <-time.After(wait):
+		}
+		res, err = s.next.Send(ctx, message)
+		attempts++
+	}
+
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		//the request gave up, that says nothing about the provider
+		s.breaker.Abandon()
+		return Result{}, ctxErr
+	}
+	if isProviderFailure(err) {
+		s.breaker.Record(err)
+	} else {
+		s.breaker.Record(nil)
+	}
+	if err != nil {
+		return Result{}, &SendError{Provider: s.name, Attempts: attempts, Err: err}
+	}
+	return res, nil
+}
+
+func reportBreakerState(name string, state string) {
+	for _, s := range []string{breaker.CLOSED, breaker.OPEN, breaker.HALF_OPEN} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		metrics.BreakerState.WithLabelValues(name, s).Set(value)
+	}
+	if state != breaker.CLOSED {
+		utils.Log.Warn(fmt.Sprintf("Circuit breaker of provider %s is %s", name, state))
+	}
+}
@@ -0,0 +1,215 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/tracing"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const HTTP = "http"
+
+// http provider auth types
+const (
+	AUTH_NONE   = "none"
+	AUTH_BASIC  = "basic"
+	AUTH_BEARER = "bearer"
+	AUTH_HEADER = "header"
+)
+
+// HTTPAuth is how requests to an HTTP provider are authenticated, secrets are read from the env keys
+type HTTPAuth struct {
+	Type        string `json:"type"`
+	UsernameEnv string `json:"usernameEnv,omitempty"`
+	PasswordEnv string `json:"passwordEnv,omitempty"`
+	TokenEnv    string `json:"tokenEnv,omitempty"`
+	// Header carries the token for the header auth type, e.g. X-API-Key
+	Header string `json:"header,omitempty"`
+}
+
+// HTTPProviderConfig describes a generic REST SMS provider. URL and Body are text/template templates
+// rendered with .To, .From, .Code and .Body, and the json and urlquery functions to escape values
+type HTTPProviderConfig struct {
+	URL         string   `json:"url"`
+	Method      string   `json:"method,omitempty"`
+	ContentType string   `json:"contentType,omitempty"`
+	Body        string   `json:"body,omitempty"`
+	From        string   `json:"from,omitempty"`
+	Auth        HTTPAuth `json:"auth,omitempty"`
+	// MessageIDField is the top level field of the JSON response holding the message id
+	MessageIDField string `json:"messageIdField,omitempty"`
+	// Timeout in seconds, defaults to 10
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// httpContent is what the url and body templates are rendered with
+type httpContent struct {
+	To   string
+	From string
+	Code string
+	Body string
+}
+
+// HTTPSender sends the OTP as an SMS through a generic REST provider
+type HTTPSender struct {
+	name   string
+	config HTTPProviderConfig
+	url    *template.Template
+	body   *template.Template
+	client *http.Client
+}
+
+var httpTemplateFuncs = template.FuncMap{
+	"json": func(value string) (string, error) {
+		b, err := json.Marshal(value)
+		return string(b), err
+	},
+	"urlquery": url.QueryEscape,
+}
+
+func NewHTTPSender(name string, config HTTPProviderConfig) (*HTTPSender, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("http provider '%s' has no url", name)
+	}
+	if config.Method == "" {
+		config.Method = http.MethodPost
+	}
+	if config.ContentType == "" {
+		config.ContentType = "application/json"
+	}
+	if config.Auth.Type == "" {
+		config.Auth.Type = AUTH_NONE
+	}
+	switch config.Auth.Type {
+	case AUTH_NONE, AUTH_BASIC, AUTH_BEARER, AUTH_HEADER:
+	default:
+		return nil, fmt.Errorf("http provider '%s' has unknown auth type '%s'", name, config.Auth.Type)
+	}
+	timeout := 10 * time.Second
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+
+	urlTemplate, err := template.New("url").Funcs(httpTemplateFuncs).Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("http provider '%s' url : %w", name, err)
+	}
+	bodyTemplate, err := template.New("body").Funcs(httpTemplateFuncs).Parse(config.Body)
+	if err != nil {
+		return nil, fmt.Errorf("http provider '%s' body : %w", name, err)
+	}
+	return &HTTPSender{
+		name:   name,
+		config: config,
+		url:    urlTemplate,
+		body:   bodyTemplate,
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// HTTPProviderError is a non 2xx answer of an HTTP provider
+type HTTPProviderError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPProviderError) Error() string {
+	return fmt.Sprintf("http provider '%s' answered %d : %s", e.Provider, e.StatusCode, e.Body)
+}
+
+func (s *HTTPSender) Send(ctx context.Context, message Message) (Result, error) {
+	ctx, span := tracing.Start(ctx, "http_provider.SendSMS", attribute.String("messaging.system", s.name))
+	start := time.Now()
+	result, err := s.send(ctx, message)
+	metrics.ProviderLatency.WithLabelValues(s.name, "send_sms", metrics.Outcome(err)).Observe(metrics.Since(start))
+	tracing.End(span, err)
+	if err != nil {
+		metrics.ProviderErrors.WithLabelValues(s.name, httpErrorCode(err)).Inc()
+		utils.Log.Debug(fmt.Sprintf("Error : Failed to send OTP message through %s", s.name))
+		return Result{}, err
+	}
+	utils.Log.Debug(fmt.Sprintf("Successfully send OTP message through %s", s.name))
+	return result, nil
+}
+
+func (s *HTTPSender) send(ctx context.Context, message Message) (Result, error) {
+	content := httpContent{
+		To:   message.To,
+		From: s.config.From,
+		Code: message.Code,
+		Body: messageBody(message.Code),
+	}
+	var target, body bytes.Buffer
+	if err := s.url.Execute(&target, content); err != nil {
+		return Result{}, err
+	}
+	if err := s.body.Execute(&body, content); err != nil {
+		return Result{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, s.config.Method, target.String(), &body)
+	if err != nil {
+		return Result{}, err
+	}
+	if body.Len() > 0 {
+		req.Header.Set("Content-Type", s.config.ContentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	auth := s.config.Auth
+	switch auth.Type {
+	case AUTH_BASIC:
+		req.SetBasicAuth(os.Getenv(auth.UsernameEnv), os.Getenv(auth.PasswordEnv))
+	case AUTH_BEARER:
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.Getenv(auth.TokenEnv)))
+	case AUTH_HEADER:
+		req.Header.Set(auth.Header, os.Getenv(auth.TokenEnv))
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return Result{}, err
+	}
+	defer res.Body.Close()
+	payload, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return Result{}, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return Result{}, &HTTPProviderError{Provider: s.name, StatusCode: res.StatusCode, Body: strings.TrimSpace(string(payload))}
+	}
+
+	result := Result{Status: "accepted"}
+	if s.config.MessageIDField != "" {
+		var fields map[string]any
+		if err := json.Unmarshal(payload, &fields); err == nil {
+			if id, ok := fields[s.config.MessageIDField]; ok {
+				result.MessageID = fmt.Sprint(id)
+			}
+		}
+	}
+	if result.MessageID == "" {
+		result.MessageID = fmt.Sprintf("%s-%s", s.name, utils.CreateOTPString(12))
+	}
+	return result, nil
+}
+
+// httpErrorCode returns the HTTP status of a provider answer as a metric label, or the kind of failure
+func httpErrorCode(err error) string {
+	if providerErr, ok := err.(*HTTPProviderError); ok {
+		return fmt.Sprint(providerErr.StatusCode)
+	}
+	return errorCode(err)
+}
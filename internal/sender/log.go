@@ -0,0 +1,24 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+// LogSender writes the OTP to the service log instead of delivering it, for local dev only
+type LogSender struct{}
+
+func NewLogSender() *LogSender {
+	return &LogSender{}
+}
+
+func (s *LogSender) Send(ctx context.Context, message Message) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	id := fmt.Sprintf("log-%s", utils.CreateOTPString(12))
+	utils.Log.Info(fmt.Sprintf("OTP %s message for %s : %s", channelName(message), message.To, messageBody(message.Code)))
+	return Result{MessageID: id, Status: "logged"}, nil
+}
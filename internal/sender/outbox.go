@@ -0,0 +1,111 @@
+package sender
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+// OutboxEntry is one message written by the OutboxSender, one JSON object per line
+type OutboxEntry struct {
+	MessageID string    `json:"messageId"`
+	To        string    `json:"to"`
+	Channel   string    `json:"channel"`
+	Language  string    `json:"language,omitempty"`
+	Code      string    `json:"code"`
+	Token     string    `json:"token,omitempty"`
+	Body      string    `json:"body"`
+	SentAt    time.Time `json:"sentAt"`
+}
+
+// OutboxSender appends every message to a file so integration tests can read the codes back
+type OutboxSender struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewOutboxSender(path string) *OutboxSender {
+	return &OutboxSender{path: path}
+}
+
+func (s *OutboxSender) Send(ctx context.Context, message Message) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	entry := OutboxEntry{
+		MessageID: fmt.Sprintf("outbox-%s", utils.CreateOTPString(12)),
+		To:        message.To,
+		Channel:   channelName(message),
+		Language:  message.Language,
+		Code:      message.Code,
+		Token:     message.Token,
+		Body:      messageBody(message.Code),
+		SentAt:    time.Now().UTC(),
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return Result{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		utils.Log.Debug("Error : Failed to create outbox directory")
+		return Result{}, err
+	}
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		utils.Log.Debug("Error : Failed to open outbox file")
+		return Result{}, err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		utils.Log.Debug("Error : Failed to write OTP message to outbox")
+		return Result{}, err
+	}
+	utils.Log.Debug("Successfully wrote OTP message to outbox")
+	return Result{MessageID: entry.MessageID, Status: "queued"}, nil
+}
+
+// ReadOutbox returns every entry in the outbox file, oldest first
+func ReadOutbox(path string) ([]OutboxEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []OutboxEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry OutboxEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// LatestCode returns the last code written to the outbox for a destination
+func LatestCode(path string, to string) (string, error) {
+	entries, err := ReadOutbox(path)
+	if err != nil {
+		return "", err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].To == to {
+			return entries[i].Code, nil
+		}
+	}
+	return "", fmt.Errorf("no message for '%s' in outbox", to)
+}
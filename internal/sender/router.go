@@ -0,0 +1,222 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/breaker"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+)
+
+const ROUTER = "router"
+
+// ProviderConfig is one SMS provider of the router. Countries are E.164 prefixes (e.g. "+91") the
+// provider is preferred for, a provider without countries serves every number
+type ProviderConfig struct {
+	Name      string             `json:"name"`
+	Type      string             `json:"type"`
+	Weight    int                `json:"weight,omitempty"`
+	Countries []string           `json:"countries,omitempty"`
+	HTTP      HTTPProviderConfig `json:"http,omitempty"`
+}
+
+// BreakerConfig overrides the breaker-* conf keys for the providers of the router, durations in seconds
+type BreakerConfig struct {
+	Window       int     `json:"window,omitempty"`
+	MinRequests  int     `json:"minRequests,omitempty"`
+	FailureRatio float64 `json:"failureRatio,omitempty"`
+	OpenFor      int     `json:"openFor,omitempty"`
+}
+
+// RouterConfig is the file at "sms-providers-path"
+type RouterConfig struct {
+	Providers []ProviderConfig `json:"providers"`
+	Breaker   BreakerConfig    `json:"breaker,omitempty"`
+}
+
+func (c BreakerConfig) breakerConfig(config breaker.Config) breaker.Config {
+	if c.Window > 0 {
+		config.Window = time.Duration(c.Window) * time.Second
+	}
+	if c.MinRequests > 0 {
+		config.MinRequests = c.MinRequests
+	}
+	if c.FailureRatio > 0 {
+		config.FailureRatio = c.FailureRatio
+	}
+	if c.OpenFor > 0 {
+		config.OpenFor = time.Duration(c.OpenFor) * time.Second
+	}
+	return config
+}
+
+// route is one provider behind the router, guarded by its own retries and circuit breaker
+type route struct {
+	name      string
+	sender    Sender
+	weight    int
+	countries []string
+}
+
+// Router sends each SMS through the providers matching the destination, ordered by weight, and
+// fails over to the next one when a provider fails with a retryable error or its circuit breaker is open
+type Router struct {
+	routes []*route
+}
+
+// LoadRouterConfig reads the provider list from path
+func LoadRouterConfig(path string) (RouterConfig, error) {
+	var config RouterConfig
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return config, fmt.Errorf("invalid sms providers in '%s' : %w", path, err)
+	}
+	if len(config.Providers) == 0 {
+		return config, fmt.Errorf("no sms providers in '%s'", path)
+	}
+	return config, nil
+}
+
+func NewRouter(config RouterConfig) (*Router, error) {
+	policy, err := GetRetryPolicy()
+	if err != nil {
+		return nil, err
+	}
+	breakerConfig, err := GetBreakerConfig()
+	if err != nil {
+		return nil, err
+	}
+	breakerConfig = config.Breaker.breakerConfig(breakerConfig)
+	router := &Router{}
+	names := make(map[string]bool)
+	for _, provider := range config.Providers {
+		if provider.Name == "" || names[provider.Name] {
+			return nil, fmt.Errorf("sms provider names must be set and unique, got '%s'", provider.Name)
+		}
+		names[provider.Name] = true
+
+		var s Sender
+		switch provider.Type {
+		case TWILIO:
+			s = NewTwilioSender()
+		case HTTP:
+			httpSender, err := NewHTTPSender(provider.Name, provider.HTTP)
+			if err != nil {
+				return nil, err
+			}
+			s = httpSender
+		default:
+			return nil, fmt.Errorf("sms provider '%s' has unknown type '%s'", provider.Name, provider.Type)
+		}
+		weight := provider.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		router.routes = append(router.routes, &route{
+			name:      provider.Name,
+			sender:    NewGuardedSender(provider.Name, s, policy, breakerConfig),
+			weight:    weight,
+			countries: provider.Countries,
+		})
+	}
+	return router, nil
+}
+
+// order returns the routes to try for a destination: providers with the longest matching country
+// prefix first, then providers without countries, each group shuffled by weight
+func (r *Router) order(to string) []*route {
+	longest := 0
+	for _, rt := range r.routes {
+		for _, prefix := range rt.countries {
+			if strings.HasPrefix(to, prefix) && len(prefix) > longest {
+				longest = len(prefix)
+			}
+		}
+	}
+
+	var preferred, fallback []*route
+	for _, rt := range r.routes {
+		if len(rt.countries) == 0 {
+			fallback = append(fallback, rt)
+			continue
+		}
+		for _, prefix := range rt.countries {
+			if strings.HasPrefix(to, prefix) && len(prefix) == longest {
+				preferred = append(preferred, rt)
+				break
+			}
+		}
+	}
+	return append(shuffleByWeight(preferred), shuffleByWeight(fallback)...)
+}
+
+// shuffleByWeight orders routes randomly, a route with twice the weight is twice as likely to come first
+func shuffleByWeight(routes []*route) []*route {
+	remaining := append([]*route(nil), routes...)
+	ordered := make([]*route, 0, len(routes))
+	for len(remaining) > 0 {
+		total := 0
+		for _, rt := range remaining {
+			total += rt.weight
+		}
+		pick := rand.Intn(total)
+		for i, rt := range remaining {
+			if pick < rt.weight {
+				ordered = append(ordered, rt)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+			pick -= rt.weight
+		}
+	}
+	return ordered
+}
+
+func (r *Router) Send(ctx context.Context, message Message) (Result, error) {
+	routes := r.order(message.To)
+	if len(routes) == 0 {
+		return Result{}, fmt.Errorf("no sms provider serves '%s'", message.To)
+	}
+
+	var errs []error
+	for i, rt := range routes {
+		res, err := rt.sender.Send(ctx, message)
+		if err == nil {
+			res.Provider = rt.name
+			return res, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return Result{}, ctxErr
+		}
+		errs = append(errs, fmt.Errorf("%s : %w", rt.name, err))
+		//a rejected message, e.g. an invalid number, would be rejected by the next provider as well
+		if !IsRetryable(err) && !errors.Is(err, breaker.ErrOpen) {
+			break
+		}
+		if i < len(routes)-1 {
+			metrics.ProviderFailovers.WithLabelValues(rt.name).Inc()
+			utils.Log.Info(fmt.Sprintf("SMS provider %s failed, failing over to the next provider", rt.name))
+		}
+	}
+	return Result{}, errors.Join(errs...)
+}
+
+// usesTwilio reports whether one of the providers is twilio
+func (r *Router) usesTwilio() bool {
+	for _, rt := range r.routes {
+		if UsesTwilio(rt.sender) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/config"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"github.com/pi-prakhar/utils/loader"
+)
+
+const (
+	TWILIO = "twilio"
+	LOG    = "log"
+	OUTBOX = "outbox"
+)
+
+// channels a message can be delivered on
+const (
+	SMS   = "sms"
+	VOICE = "voice"
+)
+
+// Message is one OTP delivery
+type Message struct {
+	To   string
+	Code string
+	// Channel is SMS when empty
+	Channel  string
+	Language string
+	// Token is a one time secret the provider presents when it calls back for content, e.g. voice TwiML
+	Token string
+	// StatusCallback is the url the provider reports delivery status changes to, none when empty
+	StatusCallback string
+}
+
+// Result is what a provider reports back once it has accepted a message
+type Result struct {
+	MessageID string `json:"messageId"`
+	Status    string `json:"status"`
+	// Provider is set by the router to the provider that accepted the message
+	Provider string `json:"provider,omitempty"`
+}
+
+// Sender delivers an OTP code to a destination, giving up once ctx is done
+type Sender interface {
+	Send(ctx context.Context, message Message) (Result, error)
+}
+
+var ErrUnsupportedChannel = errors.New("channel is not supported by this sender")
+
+// Channels sends each message through the sender registered for its channel
+type Channels map[string]Sender
+
+func (c Channels) Send(ctx context.Context, message Message) (Result, error) {
+	channel := message.Channel
+	if channel == "" {
+		channel = SMS
+	}
+	s, ok := c[channel]
+	if !ok {
+		return Result{}, fmt.Errorf("%w : %s", ErrUnsupportedChannel, channel)
+	}
+	return s.Send(ctx, message)
+}
+
+// Supports reports whether a sender is registered for channel
+func (c Channels) Supports(channel string) bool {
+	_, ok := c[channel]
+	return ok
+}
+
+// UsesTwilio reports whether s, or any sender behind it, delivers through twilio
+func UsesTwilio(s Sender) bool {
+	switch s := s.(type) {
+	case *TwilioSender, *TwilioVoiceSender, *TwilioWhatsAppSender:
+		return true
+	case Channels:
+		for _, channelSender := range s {
+			if UsesTwilio(channelSender) {
+				return true
+			}
+		}
+	case *Router:
+		return s.usesTwilio()
+	case *GuardedSender:
+		return UsesTwilio(s.next)
+	}
+	return false
+}
+
+// New builds the senders selected by "sms-sender" and "email-sender" in conf, twilio and smtp when
+// unset. The log and outbox senders record every channel, twilio sends SMS and whatsapp messages and
+// places voice calls
+func New() (Sender, error) {
+	channels, err := newPhoneChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	kind, err := utils.GetStringFromConf("email-sender", SMTP)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case SMTP:
+		host, err := utils.GetStringFromConf("smtp-host", "")
+		if err != nil {
+			return nil, err
+		}
+		if host == "" {
+			utils.Log.Warn("smtp-host not set in conf, email channel disabled")
+			break
+		}
+		smtpSender, err := NewSMTPSender()
+		if err != nil {
+			return nil, err
+		}
+		emailSender, err := guard(SMTP, smtpSender)
+		if err != nil {
+			return nil, err
+		}
+		channels[EMAIL] = emailSender
+	case LOG:
+		channels[EMAIL] = NewLogSender()
+	case OUTBOX:
+		path, err := loader.GetValueFromConf("sms-outbox-path")
+		if err != nil {
+			utils.Log.Debug("Error : Failed to load sms-outbox-path from conf")
+			return nil, err
+		}
+		channels[EMAIL] = NewOutboxSender(path)
+	default:
+		return nil, fmt.Errorf("unknown email-sender '%s'", kind)
+	}
+	return channels, nil
+}
+
+// newPhoneChannels builds the senders of the channels that reach a phone number, with the router
+// whatsapp and voice stay on twilio when one of the providers is twilio
+func newPhoneChannels() (Channels, error) {
+	kind, err := loader.GetValueFromConf("sms-sender")
+	if err != nil {
+		utils.Log.Debug("sms-sender not set in conf, using twilio")
+		kind = TWILIO
+	}
+
+	switch kind {
+	case TWILIO:
+		smsSender, err := guard(TWILIO, NewTwilioSender())
+		if err != nil {
+			return nil, err
+		}
+		return withTwilioChannels(smsSender)
+	case ROUTER:
+		path, err := utils.GetStringFromConf("sms-providers-path", "config/sms-providers.json")
+		if err != nil {
+			return nil, err
+		}
+		routerConfig, err := LoadRouterConfig(path)
+		if err != nil {
+			utils.Log.Debug("Error : Failed to load sms providers")
+			return nil, err
+		}
+		router, err := NewRouter(routerConfig)
+		if err != nil {
+			return nil, err
+		}
+		if !router.usesTwilio() {
+			return Channels{SMS: router}, nil
+		}
+		return withTwilioChannels(router)
+	case LOG:
+		logSender := NewLogSender()
+		return Channels{SMS: logSender, VOICE: logSender, WHATSAPP: logSender}, nil
+	case OUTBOX:
+		path, err := loader.GetValueFromConf("sms-outbox-path")
+		if err != nil {
+			utils.Log.Debug("Error : Failed to load sms-outbox-path from conf")
+			return nil, err
+		}
+		outboxSender := NewOutboxSender(path)
+		return Channels{SMS: outboxSender, VOICE: outboxSender, WHATSAPP: outboxSender}, nil
+	default:
+		return nil, fmt.Errorf("unknown sms-sender '%s'", kind)
+	}
+}
+
+// withTwilioChannels adds the twilio whatsapp and voice channels next to smsSender when they are configured,
+// whatsapp falls back to smsSender
+func withTwilioChannels(smsSender Sender) (Channels, error) {
+	channels := Channels{SMS: smsSender}
+	if from, templateSid, ok := config.GetTwilioWhatsAppConfig(); ok {
+		whatsAppSender, err := guard("twilio_whatsapp", NewTwilioWhatsAppSender(from, templateSid, smsSender))
+		if err != nil {
+			return nil, err
+		}
+		channels[WHATSAPP] = whatsAppSender
+	} else {
+		utils.Log.Warn("TWILIO_WHATSAPP_NUMBER or TWILIO_WHATSAPP_TEMPLATE_SID not set, whatsapp channel disabled")
+	}
+	baseURL, err := utils.GetStringFromConf("public-base-url", "")
+	if err != nil {
+		return nil, err
+	}
+	if baseURL == "" {
+		utils.Log.Warn("public-base-url not set in conf, voice channel disabled")
+	} else {
+		voiceSender, err := guard("twilio_voice", NewTwilioVoiceSender(baseURL))
+		if err != nil {
+			return nil, err
+		}
+		channels[VOICE] = voiceSender
+	}
+	return channels, nil
+}
+
+func channelName(message Message) string {
+	if message.Channel == "" {
+		return SMS
+	}
+	return message.Channel
+}
+
+func messageBody(code string) string {
+	return fmt.Sprintf("OTP message is %s", code)
+}
+
+// withContext runs a provider call that does not take a context and returns early once ctx is done,
+// the call itself is bounded by the provider http client timeout
+func withContext(ctx context.Context, call func() (Result, error)) (Result, error) {
+	type reply struct {
+		result Result
+		err    error
+	}
+	done := make(chan reply, 1)
+	go func() {
+		result, err := call()
+		done <- reply{result, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	case r := <-done:
+		return r.result, r.err
+	}
+}
@@ -0,0 +1,79 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/config"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/tracing"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"github.com/twilio/twilio-go"
+	"github.com/twilio/twilio-go/client"
+	twilioApi "github.com/twilio/twilio-go/rest/api/v2010"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// TwilioSender sends the OTP as an SMS through the Twilio messages API
+type TwilioSender struct {
+	client *twilio.RestClient
+	from   string
+}
+
+func NewTwilioSender() *TwilioSender {
+	return &TwilioSender{
+		client: config.GetTwilioClient(),
+		from:   config.GetTwilioPhoneNumber(),
+	}
+}
+
+func (s *TwilioSender) Send(ctx context.Context, message Message) (Result, error) {
+	params := &twilioApi.CreateMessageParams{}
+	params.SetTo(message.To)
+	params.SetFrom(s.from)
+	params.SetBody(messageBody(message.Code))
+	if message.StatusCallback != "" {
+		params.SetStatusCallback(message.StatusCallback)
+	}
+
+	result, err := withContext(ctx, func() (Result, error) {
+		_, span := tracing.Start(ctx, "twilio.CreateMessage", attribute.String("messaging.system", TWILIO))
+		start := time.Now()
+		res, err := s.client.Api.CreateMessage(params)
+		metrics.ProviderLatency.WithLabelValues(TWILIO, "create_message", metrics.Outcome(err)).Observe(metrics.Since(start))
+		tracing.End(span, err)
+		if err != nil {
+			return Result{}, err
+		}
+		result := Result{}
+		if res.Sid != nil {
+			result.MessageID = *res.Sid
+		}
+		if res.Status != nil {
+			result.Status = *res.Status
+		}
+		return result, nil
+	})
+	if err != nil {
+		metrics.ProviderErrors.WithLabelValues(TWILIO, errorCode(err)).Inc()
+		utils.Log.Debug("Error : Failed to send OTP message through twilio")
+		return Result{}, err
+	}
+	utils.Log.Debug("Successfully send OTP message through twilio")
+	return result, nil
+}
+
+// errorCode returns the twilio error code as a metric label, or the kind of failure for non api errors
+func errorCode(err error) string {
+	var restErr *client.TwilioRestError
+	switch {
+	case errors.As(err, &restErr):
+		return strconv.Itoa(restErr.Code)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return "timeout"
+	default:
+		return "network"
+	}
+}
@@ -0,0 +1,133 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/config"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/tracing"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"github.com/twilio/twilio-go"
+	"github.com/twilio/twilio-go/client"
+	verify "github.com/twilio/twilio-go/rest/verify/v2"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const TWILIO_VERIFY = "twilio-verify"
+
+// twilio answers 404 with this code when the verification expired, was approved or ran out of checks
+const verificationNotFound = 20404
+
+// VerifyService lets Twilio Verify generate, deliver and check the code instead of this service
+type VerifyService struct {
+	client     *twilio.RestClient
+	serviceSid string
+}
+
+func NewVerifyService() *VerifyService {
+	return &VerifyService{
+		client:     config.GetTwilioClient(),
+		serviceSid: config.GetTwilioServiceID(),
+	}
+}
+
+// Start creates a verification for to on channel, the returned MessageID is the verification SID
+func (s *VerifyService) Start(ctx context.Context, to string, channel string) (Result, error) {
+	params := &verify.CreateVerificationParams{}
+	params.SetTo(to)
+	params.SetChannel(channel)
+
+	result, err := withContext(ctx, func() (Result, error) {
+		_, span := tracing.Start(ctx, "twilio.CreateVerification", attribute.String("messaging.system", TWILIO_VERIFY))
+		start := time.Now()
+		res, err := s.client.VerifyV2.CreateVerification(s.serviceSid, params)
+		metrics.ProviderLatency.WithLabelValues(TWILIO_VERIFY, "create_verification", metrics.Outcome(err)).Observe(metrics.Since(start))
+		tracing.End(span, err)
+		if err != nil {
+			return Result{}, err
+		}
+		result := Result{}
+		if res.Sid != nil {
+			result.MessageID = *res.Sid
+		}
+		if res.Status != nil {
+			result.Status = *res.Status
+		}
+		return result, nil
+	})
+	if err != nil {
+		metrics.ProviderErrors.WithLabelValues(TWILIO_VERIFY, errorCode(err)).Inc()
+		utils.Log.Debug("Error : Failed to create twilio verification")
+		return Result{}, err
+	}
+	utils.Log.Debug("Successfully created twilio verification")
+	return result, nil
+}
+
+// Check reports whether code approves the verification, a verification twilio no longer
+// knows about (expired, already approved or out of checks) is reported as not approved
+func (s *VerifyService) Check(ctx context.Context, verificationSid string, code string) (bool, error) {
+	params := &verify.CreateVerificationCheckParams{}
+	params.SetVerificationSid(verificationSid)
+	params.SetCode(code)
+
+	result, err := withContext(ctx, func() (Result, error) {
+		_, span := tracing.Start(ctx, "twilio.CreateVerificationCheck", attribute.String("messaging.system", TWILIO_VERIFY))
+		start := time.Now()
+		res, err := s.client.VerifyV2.CreateVerificationCheck(s.serviceSid, params)
+		metrics.ProviderLatency.WithLabelValues(TWILIO_VERIFY, "create_verification_check", metrics.Outcome(err)).Observe(metrics.Since(start))
+		tracing.End(span, err)
+		if err != nil {
+			return Result{}, err
+		}
+		result := Result{MessageID: verificationSid}
+		if res.Status != nil {
+			result.Status = *res.Status
+		}
+		return result, nil
+	})
+
+	var restErr *client.TwilioRestError
+	if errors.As(err, &restErr) && restErr.Code == verificationNotFound {
+		utils.Log.Debug("Twilio verification not found, treating code as not approved")
+		return false, nil
+	}
+	if err != nil {
+		metrics.ProviderErrors.WithLabelValues(TWILIO_VERIFY, errorCode(err)).Inc()
+		utils.Log.Debug("Error : Failed to check twilio verification")
+		return false, err
+	}
+	utils.Log.Debug("Successfully checked twilio verification")
+	return result.Status == "approved", nil
+}
+
+// Cancel cancels a pending verification so its code can no longer be approved, a verification
+// twilio no longer knows about is already unusable and not an error
+func (s *VerifyService) Cancel(ctx context.Context, verificationSid string) error {
+	params := &verify.UpdateVerificationParams{}
+	params.SetStatus("canceled")
+
+	_, err := withContext(ctx, func() (Result, error) {
+		_, span := tracing.Start(ctx, "twilio.UpdateVerification", attribute.String("messaging.system", TWILIO_VERIFY))
+		start := time.Now()
+		_, err := s.client.VerifyV2.UpdateVerification(s.serviceSid, verificationSid, params)
+		metrics.ProviderLatency.WithLabelValues(TWILIO_VERIFY, "update_verification", metrics.Outcome(err)).Observe(metrics.Since(start))
+		tracing.End(span, err)
+		return Result{}, err
+	})
+
+	var restErr *client.TwilioRestError
+	if errors.As(err, &restErr) && restErr.Code == verificationNotFound {
+		utils.Log.Debug("Twilio verification not found, nothing to cancel")
+		return nil
+	}
+	if err != nil {
+		metrics.ProviderErrors.WithLabelValues(TWILIO_VERIFY, errorCode(err)).Inc()
+		utils.Log.Debug("Error : Failed to cancel twilio verification")
+		return err
+	}
+	utils.Log.Debug("Successfully canceled twilio verification")
+	return nil
+}
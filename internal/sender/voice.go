@@ -0,0 +1,115 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/config"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/tracing"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"github.com/twilio/twilio-go"
+	twilioApi "github.com/twilio/twilio-go/rest/api/v2010"
+	"github.com/twilio/twilio-go/twiml"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// VOICE_TWIML_PATH is the route twilio fetches the call script from
+const VOICE_TWIML_PATH = "/api/voice/twiml"
+
+const defaultLanguage = "en-US"
+
+// voicePhrases are the spoken lines per language prefix, the code itself is read as digits
+var voicePhrases = map[string][2]string{
+	"en": {"Your verification code is", "Once again, your code is"},
+	"es": {"Su código de verificación es", "Una vez más, su código es"},
+	"fr": {"Votre code de vérification est", "Encore une fois, votre code est"},
+	"de": {"Ihr Bestätigungscode lautet", "Noch einmal, Ihr Code lautet"},
+	"pt": {"Seu código de verificação é", "Mais uma vez, seu código é"},
+	"hi": {"आपका सत्यापन कोड है", "फिर से, आपका कोड है"},
+}
+
+// TwilioVoiceSender places a call that reads the OTP, twilio fetches the script from VOICE_TWIML_PATH
+type TwilioVoiceSender struct {
+	client  *twilio.RestClient
+	from    string
+	baseURL string
+}
+
+// NewTwilioVoiceSender builds a voice sender, baseURL is the public address twilio reaches this service on
+func NewTwilioVoiceSender(baseURL string) *TwilioVoiceSender {
+	return &TwilioVoiceSender{
+		client:  config.GetTwilioClient(),
+		from:    config.GetTwilioPhoneNumber(),
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (s *TwilioVoiceSender) Send(ctx context.Context, message Message) (Result, error) {
+	query := url.Values{}
+	query.Set("to", message.To)
+	query.Set("token", message.Token)
+
+	params := &twilioApi.CreateCallParams{}
+	params.SetTo(message.To)
+	params.SetFrom(s.from)
+	params.SetUrl(fmt.Sprintf("%s%s?%s", s.baseURL, VOICE_TWIML_PATH, query.Encode()))
+	params.SetMethod("POST")
+
+	result, err := withContext(ctx, func() (Result, error) {
+		_, span := tracing.Start(ctx, "twilio.CreateCall", attribute.String("messaging.system", TWILIO))
+		start := time.Now()
+		res, err := s.client.Api.CreateCall(params)
+		metrics.ProviderLatency.WithLabelValues(TWILIO, "create_call", metrics.Outcome(err)).Observe(metrics.Since(start))
+		tracing.End(span, err)
+		if err != nil {
+			return Result{}, err
+		}
+		result := Result{}
+		if res.Sid != nil {
+			result.MessageID = *res.Sid
+		}
+		if res.Status != nil {
+			result.Status = *res.Status
+		}
+		return result, nil
+	})
+	if err != nil {
+		metrics.ProviderErrors.WithLabelValues(TWILIO, errorCode(err)).Inc()
+		utils.Log.Debug("Error : Failed to place OTP call through twilio")
+		return Result{}, err
+	}
+	utils.Log.Debug("Successfully placed OTP call through twilio")
+	return result, nil
+}
+
+// VoiceTwiML returns the call script reading code digit by digit twice in language,
+// unknown languages are spoken with the english phrases
+func VoiceTwiML(code string, language string) (string, error) {
+	if language == "" {
+		language = defaultLanguage
+	}
+	phrases, ok := voicePhrases[strings.ToLower(strings.SplitN(language, "-", 2)[0])]
+	if !ok {
+		phrases = voicePhrases["en"]
+	}
+	digits := strings.Join(strings.Split(code, ""), ", ")
+
+	return twiml.Voice([]twiml.Element{
+		&twiml.VoicePause{Length: "1"},
+		&twiml.VoiceSay{Message: fmt.Sprintf("%s %s.", phrases[0], digits), Language: language},
+		&twiml.VoicePause{Length: "1"},
+		&twiml.VoiceSay{Message: fmt.Sprintf("%s %s.", phrases[1], digits), Language: language},
+	})
+}
+
+// ExpiredTwiML is the call script used when the code expired before twilio fetched it
+func ExpiredTwiML() (string, error) {
+	return twiml.Voice([]twiml.Element{
+		&twiml.VoiceSay{Message: "This verification code has expired. Please request a new one.", Language: defaultLanguage},
+		&twiml.VoiceHangup{},
+	})
+}
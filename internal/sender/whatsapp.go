@@ -0,0 +1,100 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/config"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/metrics"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/tracing"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"github.com/twilio/twilio-go"
+	"github.com/twilio/twilio-go/client"
+	twilioApi "github.com/twilio/twilio-go/rest/api/v2010"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const WHATSAPP = "whatsapp"
+
+// twilio error codes meaning the number can not be reached on whatsapp
+var notOnWhatsApp = map[int]bool{
+	63003: true, // channel could not find the To address
+	63024: true, // invalid message recipient
+}
+
+// NotOnWhatsApp reports whether the error code twilio sent with a message status means the number
+// can not be reached on whatsapp
+func NotOnWhatsApp(code string) bool {
+	codeInt, err := strconv.Atoi(code)
+	return err == nil && notOnWhatsApp[codeInt]
+}
+
+// TwilioWhatsAppSender sends the OTP with an approved whatsapp authentication template,
+// numbers that are not on whatsapp get the code through the fallback sender instead
+type TwilioWhatsAppSender struct {
+	client      *twilio.RestClient
+	from        string
+	templateSid string
+	fallback    Sender
+}
+
+func NewTwilioWhatsAppSender(from string, templateSid string, fallback Sender) *TwilioWhatsAppSender {
+	return &TwilioWhatsAppSender{
+		client:      config.GetTwilioClient(),
+		from:        from,
+		templateSid: templateSid,
+		fallback:    fallback,
+	}
+}
+
+func (s *TwilioWhatsAppSender) Send(ctx context.Context, message Message) (Result, error) {
+	variables, err := json.Marshal(map[string]string{"1": message.Code})
+	if err != nil {
+		return Result{}, err
+	}
+	params := &twilioApi.CreateMessageParams{}
+	params.SetTo(fmt.Sprintf("whatsapp:%s", message.To))
+	params.SetFrom(fmt.Sprintf("whatsapp:%s", s.from))
+	params.SetContentSid(s.templateSid)
+	params.SetContentVariables(string(variables))
+	if message.StatusCallback != "" {
+		params.SetStatusCallback(message.StatusCallback)
+	}
+
+	result, err := withContext(ctx, func() (Result, error) {
+		_, span := tracing.Start(ctx, "twilio.CreateMessage", attribute.String("messaging.system", TWILIO), attribute.String("otp.channel", WHATSAPP))
+		start := time.Now()
+		res, err := s.client.Api.CreateMessage(params)
+		metrics.ProviderLatency.WithLabelValues(TWILIO, "create_whatsapp_message", metrics.Outcome(err)).Observe(metrics.Since(start))
+		tracing.End(span, err)
+		if err != nil {
+			return Result{}, err
+		}
+		result := Result{}
+		if res.Sid != nil {
+			result.MessageID = *res.Sid
+		}
+		if res.Status != nil {
+			result.Status = *res.Status
+		}
+		return result, nil
+	})
+
+	var restErr *client.TwilioRestError
+	if errors.As(err, &restErr) && notOnWhatsApp[restErr.Code] && s.fallback != nil {
+		utils.Log.Info(fmt.Sprintf("Number not reachable on whatsapp (twilio error %d), falling back to sms", restErr.Code))
+		message.Channel = SMS
+		return s.fallback.Send(ctx, message)
+	}
+	if err != nil {
+		metrics.ProviderErrors.WithLabelValues(TWILIO, errorCode(err)).Inc()
+		utils.Log.Debug("Error : Failed to send OTP message through twilio whatsapp")
+		return Result{}, err
+	}
+	utils.Log.Debug("Successfully send OTP message through twilio whatsapp")
+	return result, nil
+}
@@ -0,0 +1,365 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value     string
+	list      []string  // values of a list key, see Push
+	expiresAt time.Time // zero when the key never expires
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// MemoryStore keeps OTP state in process, it is meant for local dev and tests with a single instance
+type MemoryStore struct {
+	mu        sync.Mutex
+	data      map[string]memoryEntry
+	lastSweep time.Time
+}
+
+const memorySweepInterval = time.Minute
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string]memoryEntry)}
+}
+
+// lookup returns the live entry for key and drops it when it has expired, mu must be held
+func (s *MemoryStore) lookup(key string, now time.Time) (memoryEntry, bool) {
+	entry, ok := s.data[key]
+	if !ok {
+		return memoryEntry{}, false
+	}
+	if entry.expired(now) {
+		delete(s.data, key)
+		return memoryEntry{}, false
+	}
+	return entry, true
+}
+
+// sweep drops expired keys that were never read again, mu must be held
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < memorySweepInterval {
+		return
+	}
+	for key, entry := range s.data {
+		if entry.expired(now) {
+			delete(s.data, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+func (s *MemoryStore) Set(ctx context.Context, key string, value string, expiry time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(time.Now())
+
+	entry := memoryEntry{value: value}
+	if expiry > 0 {
+		entry.expiresAt = time.Now().Add(expiry)
+	}
+	s.data[key] = entry
+	return nil
+}
+
+func (s *MemoryStore) SetNX(ctx context.Context, key string, value string, expiry time.Duration) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := s.lookup(key, now); ok {
+		return false, nil
+	}
+	entry := memoryEntry{value: value}
+	if expiry > 0 {
+		entry.expiresAt = now.Add(expiry)
+	}
+	s.data[key] = entry
+	return true, nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.lookup(key, time.Now())
+	if !ok {
+		return "", false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (s *MemoryStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return KeyMissing, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := s.lookup(key, now)
+	if !ok {
+		return KeyMissing, nil
+	}
+	if entry.expiresAt.IsZero() {
+		return NoExpiry, nil
+	}
+	// redis reports whole seconds
+	return entry.expiresAt.Sub(now).Truncate(time.Second), nil
+}
+
+func (s *MemoryStore) Decr(ctx context.Context, key string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.lookup(key, time.Now())
+	var value int64
+	if ok {
+		parsed, err := strconv.ParseInt(entry.value, 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+		value = parsed
+	}
+	value--
+	entry.value = strconv.FormatInt(value, 10)
+	s.data[key] = entry
+	return value, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, keys ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.data, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Push(ctx context.Context, key string, value string, expiry time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entry, _ := s.lookup(key, now)
+	entry.list = append(entry.list, value)
+	if expiry > 0 {
+		entry.expiresAt = now.Add(expiry)
+	}
+	s.data[key] = entry
+	return nil
+}
+
+func (s *MemoryStore) List(ctx context.Context, key string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, _ := s.lookup(key, time.Now())
+	return append([]string(nil), entry.list...), nil
+}
+
+func (s *MemoryStore) Hit(ctx context.Context, key string, limit int, window time.Duration) (HitResult, error) {
+	if err := ctx.Err(); err != nil {
+		return HitResult{}, err
+	}
+	if limit <= 0 || window <= 0 {
+		return HitResult{}, ErrInvalidLimit
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.hit(key, limit, window, time.Now())
+}
+
+// hit is Hit with mu held, the list holds the event times in unix nanoseconds, oldest first
+func (s *MemoryStore) hit(key string, limit int, window time.Duration, now time.Time) (HitResult, error) {
+	entry, _ := s.lookup(key, now)
+	events := entry.list[:0]
+	for _, event := range entry.list {
+		at, err := strconv.ParseInt(event, 10, 64)
+		if err != nil {
+			return HitResult{}, ErrNotInteger
+		}
+		if now.Sub(time.Unix(0, at)) < window {
+			events = append(events, event)
+		}
+	}
+	if len(events) >= limit {
+		entry.list = events
+		s.data[key] = entry
+		oldest, _ := strconv.ParseInt(events[0], 10, 64)
+		return HitResult{RetryAfter: time.Unix(0, oldest).Add(window).Sub(now)}, nil
+	}
+	id := strconv.FormatInt(now.UnixNano(), 10)
+	entry.list = append(events, id)
+	entry.expiresAt = now.Add(window)
+	s.data[key] = entry
+	return HitResult{Allowed: true, Remaining: limit - len(entry.list), ID: id}, nil
+}
+
+func (s *MemoryStore) Unhit(ctx context.Context, key string, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.lookup(key, time.Now())
+	if !ok {
+		return nil
+	}
+	for i, event := range entry.list {
+		if event == id {
+			entry.list = append(entry.list[:i:i], entry.list[i+1:]...)
+			s.data[key] = entry
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) RecordLock(ctx context.Context, key string, lookback time.Duration) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.recordLock(key, lookback, time.Now())
+}
+
+// recordLock is RecordLock with mu held, the history is kept like the windows of hit
+func (s *MemoryStore) recordLock(key string, lookback time.Duration, now time.Time) (int, error) {
+	if lookback <= 0 {
+		return 1, nil
+	}
+	entry, _ := s.lookup(key, now)
+	locks := entry.list[:0]
+	for _, lock := range entry.list {
+		at, err := strconv.ParseInt(lock, 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+		if now.Sub(time.Unix(0, at)) < lookback {
+			locks = append(locks, lock)
+		}
+	}
+	entry.list = append(locks, strconv.FormatInt(now.UnixNano(), 10))
+	entry.expiresAt = now.Add(lookback)
+	s.data[key] = entry
+	return len(entry.list), nil
+}
+
+func (s *MemoryStore) Restore(ctx context.Context, key string, current string, snapshots []Snapshot) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := s.lookup(key, now); !ok || entry.value != current {
+		return false, nil
+	}
+	for _, snapshot := range snapshots {
+		switch {
+		case snapshot.Found && snapshot.TTL == NoExpiry:
+			s.data[snapshot.Key] = memoryEntry{value: snapshot.Value}
+		case snapshot.Found && snapshot.TTL > 0:
+			s.data[snapshot.Key] = memoryEntry{value: snapshot.Value, expiresAt: now.Add(snapshot.TTL)}
+		default:
+			delete(s.data, snapshot.Key)
+		}
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (s *MemoryStore) VerifyCode(ctx context.Context, keys VerifyKeys, code string, policy LockPolicy) (VerifyResult, error) {
+	if err := ctx.Err(); err != nil {
+		return VerifyResult{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if lock, ok := s.lookup(keys.Lock, now); ok {
+		ttl := time.Duration(-1)
+		if !lock.expiresAt.IsZero() {
+			ttl = lock.expiresAt.Sub(now)
+		}
+		level, err := strconv.Atoi(lock.value)
+		if err != nil {
+			level = 1
+		}
+		return VerifyResult{Outcome: Locked, LockTTL: ttl, LockLevel: level}, nil
+	}
+
+	cached, found := s.lookup(keys.Code, now)
+	if found && cached.value == code {
+		delete(s.data, keys.Code)
+		delete(s.data, keys.TrialsLeft)
+		return VerifyResult{Outcome: Verified}, nil
+	}
+
+	outcome := Expired
+	if found {
+		outcome = Incorrect
+	}
+
+	entry, ok := s.lookup(keys.TrialsLeft, now)
+	if !ok {
+		return VerifyResult{Outcome: outcome}, nil
+	}
+	trials, err := strconv.Atoi(entry.value)
+	if err != nil {
+		return VerifyResult{}, ErrNotInteger
+	}
+	if trials <= 1 {
+		delete(s.data, keys.Code)
+		delete(s.data, keys.TrialsLeft)
+		level, err := s.recordLock(keys.LockHistory, policy.Lookback, now)
+		if err != nil {
+			return VerifyResult{}, err
+		}
+		lockTimeout := policy.LockTimeout(level)
+		s.data[keys.Lock] = memoryEntry{value: strconv.Itoa(level), expiresAt: now.Add(lockTimeout)}
+		return VerifyResult{Outcome: outcome, LockTTL: lockTimeout, LockedNow: true, LockLevel: level}, nil
+	}
+	entry.value = strconv.Itoa(trials - 1)
+	s.data[keys.TrialsLeft] = entry
+	return VerifyResult{Outcome: outcome, TrialsLeft: trials - 1}, nil
+}
@@ -0,0 +1,345 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// seedEvents stores events at key the way hit and recordLock keep them, ages are before now
+func seedEvents(s *MemoryStore, key string, now time.Time, ages ...time.Duration) {
+	entry := memoryEntry{expiresAt: now.Add(time.Hour)}
+	for _, age := range ages {
+		entry.list = append(entry.list, strconv.FormatInt(now.Add(-age).UnixNano(), 10))
+	}
+	s.data[key] = entry
+}
+
+func TestMemoryHit(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		ages    []time.Duration
+		limit   int
+		want    HitResult
+		wantLen int
+	}{
+		{"empty window", nil, 3, HitResult{Allowed: true, Remaining: 2}, 1},
+		{"last event", []time.Duration{time.Minute, time.Second}, 3, HitResult{Allowed: true, Remaining: 0}, 3},
+		{"full window", []time.Duration{10 * time.Minute, time.Minute, time.Second}, 3, HitResult{RetryAfter: 50 * time.Minute}, 3},
+		{"old events leave the window", []time.Duration{2 * time.Hour, time.Hour, time.Second}, 3, HitResult{Allowed: true, Remaining: 1}, 2},
+		{"limit of one", []time.Duration{30 * time.Minute}, 1, HitResult{RetryAfter: 30 * time.Minute}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			seedEvents(s, "k", now, tt.ages...)
+
+			got, err := s.hit("k", tt.limit, time.Hour, now)
+			if err != nil {
+				t.Fatalf("hit() error = %v", err)
+			}
+			if tt.want.Allowed && got.ID == "" {
+				t.Errorf("hit() allowed without an ID")
+			}
+			got.ID = ""
+			if got != tt.want {
+				t.Errorf("hit() = %+v, want %+v", got, tt.want)
+			}
+			if n := len(s.data["k"].list); n != tt.wantLen {
+				t.Errorf("window holds %d events, want %d", n, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestMemoryHitErrors(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		limit  int
+		window time.Duration
+		event  string
+		want   error
+	}{
+		{"zero limit", 0, time.Hour, "", ErrInvalidLimit},
+		{"negative limit", -1, time.Hour, "", ErrInvalidLimit},
+		{"zero window", 1, 0, "", ErrInvalidLimit},
+		{"corrupt event", 3, time.Hour, "not a time", ErrNotInteger},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			if tt.event != "" {
+				s.data["k"] = memoryEntry{list: []string{tt.event}, expiresAt: now.Add(time.Hour)}
+			}
+			if _, err := s.Hit(ctx, "k", tt.limit, tt.window); !errors.Is(err, tt.want) {
+				t.Errorf("Hit() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryUnhit(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		hits   int
+		unhit  func(ids []string) string
+		wantOK int
+	}{
+		{"first event", 2, func(ids []string) string { return ids[0] }, 1},
+		{"last event", 2, func(ids []string) string { return ids[1] }, 1},
+		{"unknown id", 2, func(ids []string) string { return "unknown" }, 0},
+		{"missing key", 0, func(ids []string) string { return "unknown" }, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			var ids []string
+			for i := 0; i < tt.hits; i++ {
+				result, err := s.Hit(ctx, "k", 2, time.Hour)
+				if err != nil {
+					t.Fatalf("Hit() error = %v", err)
+				}
+				ids = append(ids, result.ID)
+			}
+			if err := s.Unhit(ctx, "k", tt.unhit(ids)); err != nil {
+				t.Fatalf("Unhit() error = %v", err)
+			}
+
+			allowed := 0
+			for i := 0; i < 2; i++ {
+				result, err := s.Hit(ctx, "k", 2, time.Hour)
+				if err != nil {
+					t.Fatalf("Hit() error = %v", err)
+				}
+				if result.Allowed {
+					allowed++
+				}
+			}
+			if allowed != tt.wantOK {
+				t.Errorf("%d hits allowed after Unhit, want %d", allowed, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMemoryRecordLock(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		ages        []time.Duration
+		lookback    time.Duration
+		want        int
+		wantHistory int
+	}{
+		{"no history", nil, time.Hour, 1, 1},
+		{"earlier locks", []time.Duration{50 * time.Minute, time.Minute}, time.Hour, 3, 3},
+		{"old locks are forgotten", []time.Duration{2 * time.Hour, time.Minute}, time.Hour, 2, 2},
+		{"no lookback", []time.Duration{time.Minute}, 0, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			seedEvents(s, "k", now, tt.ages...)
+
+			got, err := s.recordLock("k", tt.lookback, now)
+			if err != nil {
+				t.Fatalf("recordLock() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("recordLock() = %d, want %d", got, tt.want)
+			}
+			if n := len(s.data["k"].list); n != tt.wantHistory {
+				t.Errorf("history holds %d locks, want %d", n, tt.wantHistory)
+			}
+		})
+	}
+}
+
+var testKeys = VerifyKeys{Code: "code", TrialsLeft: "trials", Lock: "lock", LockHistory: "history"}
+
+var testPolicy = LockPolicy{Timeout: 10 * time.Minute, Multiplier: 2, Max: time.Hour, Lookback: 24 * time.Hour}
+
+// verifyCase is one VerifyCode call on a store prepared by setup, shared with the redis parity test
+type verifyCase struct {
+	name  string
+	setup func(ctx context.Context, s OTPStore) error
+	code  string
+	want  VerifyResult
+	// wantCode is whether the code is still cached afterwards
+	wantCode bool
+	wantLock bool
+}
+
+// setCode caches code with trials, the way issuing a code does
+func setCode(code string, trials int) func(ctx context.Context, s OTPStore) error {
+	return func(ctx context.Context, s OTPStore) error {
+		if code != "" {
+			if err := s.Set(ctx, testKeys.Code, code, time.Hour); err != nil {
+				return err
+			}
+		}
+		if trials > 0 {
+			return s.Set(ctx, testKeys.TrialsLeft, strconv.Itoa(trials), time.Hour)
+		}
+		return nil
+	}
+}
+
+var verifyCases = []verifyCase{
+	{name: "correct code", setup: setCode("123456", 3), code: "123456",
+		want: VerifyResult{Outcome: Verified}},
+	{name: "wrong code", setup: setCode("123456", 3), code: "000000",
+		want: VerifyResult{Outcome: Incorrect, TrialsLeft: 2}, wantCode: true},
+	{name: "expired code", setup: setCode("", 2), code: "123456",
+		want: VerifyResult{Outcome: Expired, TrialsLeft: 1}},
+	{name: "no trials left key", setup: setCode("123456", 0), code: "000000",
+		want: VerifyResult{Outcome: Incorrect}, wantCode: true},
+	{name: "last trial locks", setup: setCode("123456", 1), code: "000000",
+		want: VerifyResult{Outcome: Incorrect, LockTTL: 10 * time.Minute, LockedNow: true, LockLevel: 1}, wantLock: true},
+	{name: "last trial after an earlier lock", setup: func(ctx context.Context, s OTPStore) error {
+		if _, err := s.RecordLock(ctx, testKeys.LockHistory, testPolicy.Lookback); err != nil {
+			return err
+		}
+		return setCode("123456", 1)(ctx, s)
+	}, code: "000000",
+		want: VerifyResult{Outcome: Incorrect, LockTTL: 20 * time.Minute, LockedNow: true, LockLevel: 2}, wantLock: true},
+	{name: "locked", setup: func(ctx context.Context, s OTPStore) error {
+		if err := s.Set(ctx, testKeys.Lock, "3", 5*time.Minute); err != nil {
+			return err
+		}
+		return setCode("123456", 3)(ctx, s)
+	}, code: "123456",
+		want: VerifyResult{Outcome: Locked, LockTTL: 5 * time.Minute, LockLevel: 3}, wantCode: true, wantLock: true},
+}
+
+// checkVerify runs c against s and compares the result, lock times are compared to the second
+func checkVerify(t *testing.T, s OTPStore, c verifyCase) {
+	t.Helper()
+	ctx := context.Background()
+	if err := c.setup(ctx, s); err != nil {
+		t.Fatalf("setup error = %v", err)
+	}
+	got, err := s.VerifyCode(ctx, testKeys, c.code, testPolicy)
+	if err != nil {
+		t.Fatalf("VerifyCode() error = %v", err)
+	}
+	got.LockTTL = got.LockTTL.Round(time.Second)
+	if got != c.want {
+		t.Errorf("VerifyCode() = %+v, want %+v", got, c.want)
+	}
+	if _, found, _ := s.Get(ctx, testKeys.Code); found != c.wantCode {
+		t.Errorf("code cached = %t, want %t", found, c.wantCode)
+	}
+	if _, found, _ := s.Get(ctx, testKeys.Lock); found != c.wantLock {
+		t.Errorf("lock set = %t, want %t", found, c.wantLock)
+	}
+}
+
+func TestMemoryVerifyCode(t *testing.T) {
+	for _, c := range verifyCases {
+		t.Run(c.name, func(t *testing.T) {
+			checkVerify(t, NewMemoryStore(), c)
+		})
+	}
+}
+
+// restoreCase restores two keys, "guard" holding the value a change set and "other"
+type restoreCase struct {
+	name      string
+	guard     string
+	current   string
+	snapshots []Snapshot
+	want      bool
+	// wantValues are the values afterwards, empty for missing keys
+	wantValues map[string]string
+	wantTTLs   map[string]time.Duration
+}
+
+var restoreCases = []restoreCase{
+	{
+		name: "puts values back", guard: "new", current: "new",
+		snapshots: []Snapshot{
+			{Key: "guard", Value: "old", Found: true, TTL: time.Minute},
+			{Key: "other", Value: "3", Found: true, TTL: NoExpiry},
+		},
+		want:       true,
+		wantValues: map[string]string{"guard": "old", "other": "3"},
+		wantTTLs:   map[string]time.Duration{"guard": time.Minute, "other": NoExpiry},
+	},
+	{
+		name: "deletes keys that were missing", guard: "new", current: "new",
+		snapshots:  []Snapshot{{Key: "guard"}, {Key: "other"}},
+		want:       true,
+		wantValues: map[string]string{"guard": "", "other": ""},
+	},
+	{
+		name: "deletes keys that expired meanwhile", guard: "new", current: "new",
+		snapshots:  []Snapshot{{Key: "guard", Value: "old", Found: true}},
+		want:       true,
+		wantValues: map[string]string{"guard": ""},
+	},
+	{
+		name: "keeps a newer value", guard: "newer", current: "new",
+		snapshots:  []Snapshot{{Key: "guard", Value: "old", Found: true, TTL: time.Minute}, {Key: "other"}},
+		wantValues: map[string]string{"guard": "newer", "other": "changed"},
+	},
+	{
+		name: "keeps a missing guard", current: "new",
+		snapshots:  []Snapshot{{Key: "guard", Value: "old", Found: true, TTL: time.Minute}},
+		wantValues: map[string]string{"guard": ""},
+	},
+}
+
+// checkRestore runs c against s, other holds "changed" before the restore
+func checkRestore(t *testing.T, s OTPStore, c restoreCase) {
+	t.Helper()
+	ctx := context.Background()
+	if c.guard != "" {
+		if err := s.Set(ctx, "guard", c.guard, time.Hour); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	if err := s.Set(ctx, "other", "changed", time.Hour); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	got, err := s.Restore(ctx, "guard", c.current, c.snapshots)
+	if err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if got != c.want {
+		t.Errorf("Restore() = %t, want %t", got, c.want)
+	}
+	for key, want := range c.wantValues {
+		if value, _, _ := s.Get(ctx, key); value != want {
+			t.Errorf("%s = %q, want %q", key, value, want)
+		}
+	}
+	for key, want := range c.wantTTLs {
+		ttl, _ := s.TTL(ctx, key)
+		if want > 0 {
+			ttl = ttl.Round(time.Minute)
+		}
+		if ttl != want {
+			t.Errorf("TTL of %s = %s, want %s", key, ttl, want)
+		}
+	}
+}
+
+func TestMemoryRestore(t *testing.T) {
+	for _, c := range restoreCases {
+		t.Run(c.name, func(t *testing.T) {
+			checkRestore(t, NewMemoryStore(), c)
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisStore keeps OTP state in redis through the shared client
+type RedisStore struct {
+	rdb redis.UniversalClient
+}
+
+func NewRedisStore(rdb redis.UniversalClient) *RedisStore {
+	return &RedisStore{rdb: rdb}
+}
+
+func (s *RedisStore) Set(ctx context.Context, key string, value string, expiry time.Duration) error {
+	return s.rdb.Set(ctx, key, value, expiry).Err()
+}
+
+func (s *RedisStore) SetNX(ctx context.Context, key string, value string, expiry time.Duration) (bool, error) {
+	return s.rdb.SetNX(ctx, key, value, expiry).Result()
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (string, bool, error) {
+	value, err := s.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (s *RedisStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return s.rdb.TTL(ctx, key).Result()
+}
+
+func (s *RedisStore) Decr(ctx context.Context, key string) (int64, error) {
+	return s.rdb.Decr(ctx, key).Result()
+}
+
+func (s *RedisStore) Delete(ctx context.Context, keys ...string) error {
+	return s.rdb.Del(ctx, keys...).Err()
+}
+
+func (s *RedisStore) Push(ctx context.Context, key string, value string, expiry time.Duration) error {
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, value)
+		if expiry > 0 {
+			pipe.PExpire(ctx, key, expiry)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) List(ctx context.Context, key string) ([]string, error) {
+	return s.rdb.LRange(ctx, key, 0, -1).Result()
+}
+
+// hitScript returns {allowed, remaining, retry after in ms}, events are scored by their time in ms
+// KEYS : window
+// ARGV : now in ms, window in ms, limit, event id
+var hitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+if count >= limit then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	return {0, 0, tonumber(oldest[2]) + window - now}
+end
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], window)
+return {1, limit - count - 1, 0}
+`)
+
+func (s *RedisStore) Hit(ctx context.Context, key string, limit int, window time.Duration) (HitResult, error) {
+	if limit <= 0 || window <= 0 {
+		return HitResult{}, ErrInvalidLimit
+	}
+	now := time.Now().UnixMilli()
+	id := fmt.Sprintf("%d-%d", now, rand.Int63())
+	reply, err := hitScript.Run(ctx, s.rdb, []string{key},
+		now, window.Milliseconds(), limit, id,
+	).Int64Slice()
+	if err != nil {
+		return HitResult{}, err
+	}
+	if len(reply) != 3 {
+		return HitResult{}, fmt.Errorf("unexpected hit script reply %v", reply)
+	}
+	result := HitResult{
+		Allowed:    reply[0] == 1,
+		Remaining:  int(reply[1]),
+		RetryAfter: time.Duration(reply[2]) * time.Millisecond,
+	}
+	if result.Allowed {
+		result.ID = id
+	}
+	return result, nil
+}
+
+func (s *RedisStore) Unhit(ctx context.Context, key string, id string) error {
+	return s.rdb.ZRem(ctx, key, id).Err()
+}
+
+// restoreScript returns 1 when the keys were restored, 0 when the guard key changed
+// KEYS : guard key, then the keys to restore
+// ARGV : current value of the guard key, then found (1 or 0), value and ttl in ms (-1 for no expiry)
+// of every key to restore
+var restoreScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+for i = 2, #KEYS do
+	local found = ARGV[i * 3 - 4]
+	local value = ARGV[i * 3 - 3]
+	local ttl = tonumber(ARGV[i * 3 - 2])
+	if found == '1' and ttl == -1 then
+		redis.call('SET', KEYS[i], value)
+	elseif found == '1' and ttl > 0 then
+		redis.call('SET', KEYS[i], value, 'PX', ttl)
+	else
+		redis.call('DEL', KEYS[i])
+	end
+end
+return 1
+`)
+
+func (s *RedisStore) Restore(ctx context.Context, key string, current string, snapshots []Snapshot) (bool, error) {
+	keys := []string{key}
+	args := []any{current}
+	for _, snapshot := range snapshots {
+		found, ttl := 0, int64(0)
+		if snapshot.Found {
+			found, ttl = 1, snapshot.TTL.Milliseconds()
+		}
+		if snapshot.Found && snapshot.TTL == NoExpiry {
+			ttl = -1
+		}
+		keys = append(keys, snapshot.Key)
+		args = append(args, found, snapshot.Value, ttl)
+	}
+	restored, err := restoreScript.Run(ctx, s.rdb, keys, args...).Int()
+	return restored == 1, err
+}
+
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.rdb.Ping(ctx).Err()
+}
+
+// recordLockLua defines record_lock, which adds a lock to the history at key and returns its level: one
+// above the locks within the lookback, kept scored by their time in ms like the windows of Hit
+const recordLockLua = `
+local function record_lock(key, lookback, now, id)
+	if lookback <= 0 then
+		return 1
+	end
+	redis.call('ZREMRANGEBYSCORE', key, '-inf', now - lookback)
+	local level = redis.call('ZCARD', key) + 1
+	redis.call('ZADD', key, now, id)
+	redis.call('PEXPIRE', key, lookback)
+	return level
+end
+`
+
+// recordLockScript returns the level of the new lock
+// KEYS : lock history
+// ARGV : lookback in ms, now in ms, lock id
+var recordLockScript = redis.NewScript(recordLockLua + `
+return record_lock(KEYS[1], tonumber(ARGV[1]), tonumber(ARGV[2]), ARGV[3])
+`)
+
+func (s *RedisStore) RecordLock(ctx context.Context, key string, lookback time.Duration) (int, error) {
+	now := time.Now().UnixMilli()
+	level, err := recordLockScript.Run(ctx, s.rdb, []string{key},
+		lookback.Milliseconds(), now, fmt.Sprintf("%d-%d", now, rand.Int63()),
+	).Int()
+	if err != nil {
+		return 0, err
+	}
+	return level, nil
+}
+
+// verifyScript returns {outcome, trials left, lock ttl in ms, locked now, lock level}. The lock timeouts
+// of the policy are passed in by level, levels past the last one last as long as the last
+// KEYS : code, trials left, lock, lock history
+// ARGV : submitted code, lookback in ms, now in ms, lock id, lock timeouts in ms from level 1
+var verifyScript = redis.NewScript(recordLockLua + `
+local lockTTL = redis.call('PTTL', KEYS[3])
+if lockTTL ~= -2 then
+	return {3, 0, lockTTL, 0, tonumber(redis.call('GET', KEYS[3])) or 1}
+end
+
+local cached = redis.call('GET', KEYS[1])
+if cached and cached == ARGV[1] then
+	redis.call('DEL', KEYS[1], KEYS[2])
+	return {0, 0, 0, 0, 0}
+end
+
+local outcome = 2
+if cached then
+	outcome = 1
+end
+
+local trials = tonumber(redis.call('GET', KEYS[2]))
+if trials == nil then
+	return {outcome, 0, 0, 0, 0}
+end
+if trials <= 1 then
+	redis.call('DEL', KEYS[1], KEYS[2])
+	local level = record_lock(KEYS[4], tonumber(ARGV[2]), tonumber(ARGV[3]), ARGV[4])
+	local timeout = tonumber(ARGV[4 + math.min(level, #ARGV - 4)])
+	redis.call('SET', KEYS[3], level, 'PX', timeout)
+	return {outcome, 0, timeout, 1, level}
+end
+return {outcome, redis.call('DECR', KEYS[2]), 0, 0, 0}
+`)
+
+func (s *RedisStore) VerifyCode(ctx context.Context, keys VerifyKeys, code string, policy LockPolicy) (VerifyResult, error) {
+	now := time.Now().UnixMilli()
+	args := []any{code, policy.Lookback.Milliseconds(), now, fmt.Sprintf("%d-%d", now, rand.Int63())}
+	for _, timeout := range policy.LockTimeouts() {
+		args = append(args, timeout.Milliseconds())
+	}
+	reply, err := verifyScript.Run(ctx, s.rdb,
+		[]string{keys.Code, keys.TrialsLeft, keys.Lock, keys.LockHistory}, args...,
+	).Int64Slice()
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	if len(reply) != 5 {
+		return VerifyResult{}, fmt.Errorf("unexpected verify script reply %v", reply)
+	}
+
+	return VerifyResult{
+		Outcome:    VerifyOutcome(reply[0]),
+		TrialsLeft: int(reply[1]),
+		LockTTL:    time.Duration(reply[2]) * time.Millisecond,
+		LockedNow:  reply[3] == 1,
+		LockLevel:  int(reply[4]),
+	}, nil
+}
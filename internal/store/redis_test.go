@@ -0,0 +1,143 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestRedisStore runs the scripts of the redis store against miniredis, the tests below expect the
+// same results as from the memory store
+func newTestRedisStore(t *testing.T) *RedisStore {
+	t.Helper()
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return NewRedisStore(rdb)
+}
+
+// parityStores returns a fresh store of every kind
+func parityStores(t *testing.T) map[string]OTPStore {
+	return map[string]OTPStore{
+		"memory": NewMemoryStore(),
+		"redis":  newTestRedisStore(t),
+	}
+}
+
+func TestHitParity(t *testing.T) {
+	// unhit is the number of the earlier hit given back before the step, 0 for none
+	type step struct {
+		unhit int
+		want  HitResult
+	}
+	tests := []struct {
+		name  string
+		limit int
+		steps []step
+	}{
+		{"fills the window", 3, []step{
+			{want: HitResult{Allowed: true, Remaining: 2}},
+			{want: HitResult{Allowed: true, Remaining: 1}},
+			{want: HitResult{Allowed: true, Remaining: 0}},
+			{want: HitResult{RetryAfter: time.Hour}},
+		}},
+		{"refund frees a slot", 2, []step{
+			{want: HitResult{Allowed: true, Remaining: 1}},
+			{want: HitResult{Allowed: true, Remaining: 0}},
+			{unhit: 1, want: HitResult{Allowed: true, Remaining: 0}},
+			{want: HitResult{RetryAfter: time.Hour}},
+		}},
+		{"refused hits are not recorded", 1, []step{
+			{want: HitResult{Allowed: true, Remaining: 0}},
+			{want: HitResult{RetryAfter: time.Hour}},
+			{unhit: 1, want: HitResult{Allowed: true, Remaining: 0}},
+		}},
+	}
+	for _, tt := range tests {
+		for kind, s := range parityStores(t) {
+			t.Run(tt.name+"/"+kind, func(t *testing.T) {
+				ctx := context.Background()
+				var ids []string
+				for i, step := range tt.steps {
+					if step.unhit > 0 {
+						if err := s.Unhit(ctx, "k", ids[step.unhit-1]); err != nil {
+							t.Fatalf("Unhit() error = %v", err)
+						}
+					}
+					got, err := s.Hit(ctx, "k", tt.limit, time.Hour)
+					if err != nil {
+						t.Fatalf("Hit() error = %v", err)
+					}
+					ids = append(ids, got.ID)
+					if got.Allowed == (got.ID == "") {
+						t.Errorf("step %d: Hit() allowed = %t with ID %q", i, got.Allowed, got.ID)
+					}
+					got.ID = ""
+					got.RetryAfter = got.RetryAfter.Round(time.Minute)
+					if got != step.want {
+						t.Errorf("step %d: Hit() = %+v, want %+v", i, got, step.want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestHitInvalidLimitParity(t *testing.T) {
+	for kind, s := range parityStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			if _, err := s.Hit(context.Background(), "k", 0, time.Hour); err != ErrInvalidLimit {
+				t.Errorf("Hit() error = %v, want %v", err, ErrInvalidLimit)
+			}
+		})
+	}
+}
+
+func TestRecordLockParity(t *testing.T) {
+	tests := []struct {
+		name     string
+		lookback time.Duration
+		want     []int
+	}{
+		{"levels go up", time.Hour, []int{1, 2, 3}},
+		{"no lookback", 0, []int{1, 1, 1}},
+	}
+	for _, tt := range tests {
+		for kind, s := range parityStores(t) {
+			t.Run(tt.name+"/"+kind, func(t *testing.T) {
+				for i, want := range tt.want {
+					got, err := s.RecordLock(context.Background(), "history", tt.lookback)
+					if err != nil {
+						t.Fatalf("RecordLock() error = %v", err)
+					}
+					if got != want {
+						t.Errorf("lock %d: RecordLock() = %d, want %d", i, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyCodeParity(t *testing.T) {
+	for _, c := range verifyCases {
+		for kind, s := range parityStores(t) {
+			t.Run(c.name+"/"+kind, func(t *testing.T) {
+				checkVerify(t, s, c)
+			})
+		}
+	}
+}
+
+func TestRestoreParity(t *testing.T) {
+	for _, c := range restoreCases {
+		for kind, s := range parityStores(t) {
+			t.Run(c.name+"/"+kind, func(t *testing.T) {
+				checkRestore(t, s, c)
+			})
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/database"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"github.com/pi-prakhar/utils/loader"
+)
+
+const (
+	REDIS  = "redis"
+	MEMORY = "memory"
+)
+
+// TTL values returned for keys without expiry and for missing keys, same as go-redis
+const (
+	NoExpiry   = time.Duration(-1)
+	KeyMissing = time.Duration(-2)
+)
+
+var ErrNotInteger = errors.New("value is not an integer or out of range")
+
+var ErrInvalidLimit = errors.New("limit and window must be positive")
+
+// Snapshot is the value and time left of a key before a change, see Restore
+type Snapshot struct {
+	Key   string
+	Value string
+	Found bool
+	// TTL is the time left or NoExpiry, only set when Found
+	TTL time.Duration
+}
+
+// OTPStore holds OTP codes, trial counters and locks, every key can carry an expiry.
+// Every call gives up once ctx is done
+type OTPStore interface {
+	// Set stores value under key, an expiry of 0 keeps the key forever
+	Set(ctx context.Context, key string, value string, expiry time.Duration) error
+	// SetNX stores value under key only when key is missing, stored is false when it already exists
+	SetNX(ctx context.Context, key string, value string, expiry time.Duration) (stored bool, err error)
+	// Get returns the value of key, found is false when the key is missing or expired
+	Get(ctx context.Context, key string) (value string, found bool, err error)
+	// TTL returns the time left on key, NoExpiry or KeyMissing
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// Decr decrements the integer stored at key and returns the new value, keeping its expiry
+	Decr(ctx context.Context, key string) (int64, error)
+	// Delete removes the keys, missing keys are ignored
+	Delete(ctx context.Context, keys ...string) error
+	// Push appends value to the list at key and resets the expiry of the list
+	Push(ctx context.Context, key string, value string, expiry time.Duration) error
+	// List returns every value of the list at key, oldest first, empty when the key is missing
+	List(ctx context.Context, key string) ([]string, error)
+	// Hit records one event in the rolling window at key unless limit events happened within window,
+	// refused events are not recorded. limit and window must be positive
+	Hit(ctx context.Context, key string, limit int, window time.Duration) (HitResult, error)
+	// Unhit removes the event id recorded by Hit from the window at key, so it no longer counts
+	Unhit(ctx context.Context, key string, id string) error
+	// RecordLock adds a lock to the history at key and returns its level, one above the locks recorded
+	// within lookback. A lookback of 0 keeps no history and every lock is level 1
+	RecordLock(ctx context.Context, key string, lookback time.Duration) (int, error)
+	// Restore puts the snapshots back as long as key still holds current, all in one atomic step. Keys
+	// that were not found or expired since are deleted. restored is false when key changed meanwhile
+	Restore(ctx context.Context, key string, current string, snapshots []Snapshot) (restored bool, err error)
+	// Ping checks the backend is reachable
+	Ping(ctx context.Context) error
+	// VerifyCode checks code against the cached one and consumes it, or counts the failed trial and
+	// locks the number for the next level of policy once trials run out, all in one atomic step
+	VerifyCode(ctx context.Context, keys VerifyKeys, code string, policy LockPolicy) (VerifyResult, error)
+}
+
+// New builds the store selected by "otp-store" in conf, redis when unset
+func New() (OTPStore, error) {
+	kind, err := loader.GetValueFromConf("otp-store")
+	if err != nil {
+		utils.Log.Debug("otp-store not set in conf, using redis")
+		kind = REDIS
+	}
+
+	switch kind {
+	case REDIS:
+		if err := database.Init(); err != nil {
+			utils.Log.Debug("Error : Failed to create redis client")
+			return nil, err
+		}
+		return NewRedisStore(database.Client()), nil
+	case MEMORY:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown otp-store '%s'", kind)
+	}
+}
@@ -0,0 +1,87 @@
+package store
+
+import "time"
+
+type VerifyOutcome int
+
+const (
+	Verified VerifyOutcome = iota
+	Incorrect
+	Expired
+	Locked
+)
+
+func (o VerifyOutcome) String() string {
+	switch o {
+	case Verified:
+		return "verified"
+	case Incorrect:
+		return "incorrect"
+	case Expired:
+		return "expired"
+	case Locked:
+		return "locked"
+	default:
+		return "unknown"
+	}
+}
+
+// VerifyKeys are the keys VerifyCode reads and updates for one phone number
+type VerifyKeys struct {
+	Code       string
+	TrialsLeft string
+	Lock       string
+	// LockHistory is the rolling window of the locks of the number, see LockPolicy
+	LockHistory string
+}
+
+// LockPolicy is how long VerifyCode locks a number. Every lock within Lookback of earlier ones is a level
+// up and lasts Multiplier times as long as the level before, up to Max
+type LockPolicy struct {
+	Timeout    time.Duration
+	Multiplier int
+	Max        time.Duration
+	Lookback   time.Duration
+}
+
+// LockTimeouts returns how long a lock of every level lasts, from level 1 up to the first level that
+// reaches Max. Later levels last as long as the last one
+func (p LockPolicy) LockTimeouts() []time.Duration {
+	limit := max(p.Max, p.Timeout)
+	timeouts := []time.Duration{p.Timeout}
+	for timeout := p.Timeout; p.Multiplier > 1 && timeout > 0 && timeout < limit; {
+		timeout = min(timeout*time.Duration(p.Multiplier), limit)
+		timeouts = append(timeouts, timeout)
+	}
+	return timeouts
+}
+
+// LockTimeout returns how long a lock of level lasts, levels start at 1
+func (p LockPolicy) LockTimeout(level int) time.Duration {
+	timeouts := p.LockTimeouts()
+	return timeouts[min(max(level, 1), len(timeouts))-1]
+}
+
+// VerifyResult is the single decision taken by VerifyCode
+type VerifyResult struct {
+	Outcome VerifyOutcome
+	// TrialsLeft after this attempt, only set for Incorrect and Expired
+	TrialsLeft int
+	// LockTTL is the time left on the lock, set for Locked and when this attempt locked the number
+	LockTTL time.Duration
+	// LockedNow is true when this attempt used the last trial and locked the number
+	LockedNow bool
+	// LockLevel is the level of the lock, set with LockTTL
+	LockLevel int
+}
+
+// HitResult is the rolling window of Hit after one event
+type HitResult struct {
+	Allowed bool
+	// Remaining events in the window after this one
+	Remaining int
+	// RetryAfter is the time until the oldest event leaves the window, only set when refused
+	RetryAfter time.Duration
+	// ID of the recorded event for Unhit, only set when allowed
+	ID string
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLockTimeout(t *testing.T) {
+	escalating := LockPolicy{Timeout: 10 * time.Minute, Multiplier: 3, Max: time.Hour}
+
+	tests := []struct {
+		name   string
+		policy LockPolicy
+		level  int
+		want   time.Duration
+	}{
+		{"level 0 is level 1", escalating, 0, 10 * time.Minute},
+		{"level 1", escalating, 1, 10 * time.Minute},
+		{"level 2", escalating, 2, 30 * time.Minute},
+		{"capped at max", escalating, 3, time.Hour},
+		{"past the last level", escalating, 7, time.Hour},
+		{"no multiplier", LockPolicy{Timeout: 10 * time.Minute, Multiplier: 1, Max: time.Hour}, 3, 10 * time.Minute},
+		{"max below timeout", LockPolicy{Timeout: 10 * time.Minute, Multiplier: 2, Max: time.Minute}, 3, 10 * time.Minute},
+		{"no max", LockPolicy{Timeout: 10 * time.Minute, Multiplier: 2}, 3, 10 * time.Minute},
+		{"no timeout", LockPolicy{Multiplier: 2, Max: time.Hour}, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.LockTimeout(tt.level); got != tt.want {
+				t.Errorf("LockTimeout(%d) = %s, want %s", tt.level, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLockTimeouts(t *testing.T) {
+	policy := LockPolicy{Timeout: 10 * time.Minute, Multiplier: 2, Max: time.Hour}
+	want := []time.Duration{10 * time.Minute, 20 * time.Minute, 40 * time.Minute, time.Hour}
+	if got := policy.LockTimeouts(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("LockTimeouts() = %v, want %v", got, want)
+	}
+}
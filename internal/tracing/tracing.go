@@ -0,0 +1,140 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/internal/response"
+	"github.com/pi-prakhar/go-redis-twilio-phone-otp/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	NONE   = "none"
+	STDOUT = "stdout"
+	OTLP   = "otlp"
+)
+
+const tracerName = "github.com/pi-prakhar/go-redis-twilio-phone-otp"
+
+// Init sets the global tracer provider from conf and returns the function flushing spans on shutdown,
+// with "tracing-exporter" none spans are still created but dropped
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	kind, err := utils.GetStringFromConf("tracing-exporter", NONE)
+	if err != nil {
+		return nil, err
+	}
+	var exporter sdktrace.SpanExporter
+	switch kind {
+	case NONE:
+		utils.Log.Info("Tracing exporter disabled")
+		return func(context.Context) error { return nil }, nil
+	case STDOUT:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case OTLP:
+		exporter, err = newOTLPExporter(ctx)
+	default:
+		return nil, fmt.Errorf("unknown tracing-exporter '%s'", kind)
+	}
+	if err != nil {
+		utils.Log.Debug("Error : Failed to create tracing exporter")
+		return nil, err
+	}
+
+	serviceName, err := utils.GetStringFromConf("service_name", "GO-PHONE-OTP-SERVICE")
+	if err != nil {
+		return nil, err
+	}
+	sampleRatio, err := utils.GetIntFromConf("tracing-sample-percent", 100)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(float64(sampleRatio)/100))),
+	)
+	otel.SetTracerProvider(provider)
+	utils.Log.Info(fmt.Sprintf("Tracing enabled with %s exporter", kind))
+	return provider.Shutdown, nil
+}
+
+func newOTLPExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	endpoint, err := utils.GetStringFromConf("tracing-otlp-endpoint", "localhost:4318")
+	if err != nil {
+		return nil, err
+	}
+	insecure, err := utils.GetBoolFromConf("tracing-otlp-insecure", true)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	return otlptracehttp.New(ctx, options...)
+}
+
+// Start starts a child span of the span in ctx
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End records err on span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Middleware continues the W3C trace context of the incoming request and wraps the handler
+// in a server span named after the mux route template
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		ctx, span := otel.Tracer(tracerName).Start(ctx, fmt.Sprintf("%s %s", r.Method, route),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+			),
+		)
+		defer span.End()
+
+		recorder := response.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.Status))
+		if recorder.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.Status))
+		}
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator"
@@ -16,6 +17,17 @@ import (
 const OTP_CODE = "otp_code"
 const OTP_LOCK = "lock"
 const OTP_TRIAL_LEFT = "otp_trial_left"
+const OTP_VOICE_TOKEN = "voice_token"
+const OTP_DELIVERY = "delivery"
+const OTP_FALLBACK = "fallback"
+const OTP_DELIVERY_STATUS = "delivery_status"
+const OTP_VERIFICATION = "verification"
+const OTP_RESEND = "resend"
+const OTP_LIMIT = "limit"
+const OTP_LOCK_HISTORY = "lock_history"
+const OTP_STATUS_CALLBACK = "status_callback"
+const OTP_LAST_SENT = "last_sent"
+const OTP_APPROVED = "approved"
 
 var validate = validator.New()
 
@@ -101,14 +113,197 @@ func CreateOTPString(maxDigits int) string {
 	return string(b)
 }
 
-func GetOTPTrialsLeftKey(phoneNumber string) string {
-	return fmt.Sprintf("%s_%s", phoneNumber, OTP_TRIAL_LEFT)
+// identifier types, keys are namespaced by the type so a phone number and an email never share state
+const PHONE = "phone"
+const EMAIL = "email"
+
+// GetIdentifier returns the namespaced identifier keys are built from, e.g. "phone:+14155552671"
+func GetIdentifier(kind string, value string) string {
+	return fmt.Sprintf("%s:%s", kind, value)
+}
+
+// keys of one identifier share the {identifier} hash tag so they land in the same redis cluster slot
+
+func GetOTPTrialsLeftKey(identifier string) string {
+	return fmt.Sprintf("{%s}_%s", identifier, OTP_TRIAL_LEFT)
+}
+
+func GetOTPCodeKey(identifier string) string {
+	return fmt.Sprintf("{%s}_%s", identifier, OTP_CODE)
+}
+
+func GetOTPLockKey(identifier string) string {
+	return fmt.Sprintf("{%s}_%s", identifier, OTP_LOCK)
+}
+
+// ParseLegacyOTPLockKey returns the identifier of a key older versions locked a phone number under,
+// before keys were hash tagged ("+14155552671_lock") and before they were namespaced
+// ("{+14155552671}_lock"). Emails were only ever stored under namespaced keys
+func ParseLegacyOTPLockKey(key string) (string, bool) {
+	phoneNumber, found := strings.CutSuffix(key, "_"+OTP_LOCK)
+	if !found {
+		return "", false
+	}
+	if tagged, found := strings.CutPrefix(phoneNumber, "{"); found {
+		if phoneNumber, found = strings.CutSuffix(tagged, "}"); !found {
+			return "", false
+		}
+	}
+	if !strings.HasPrefix(phoneNumber, "+") || strings.ContainsAny(phoneNumber, "{}:_") {
+		return "", false
+	}
+	return GetIdentifier(PHONE, phoneNumber), true
+}
+
+// GetOTPLockHistoryKey holds the recent locks of the identifier, each one escalates the next
+func GetOTPLockHistoryKey(identifier string) string {
+	return fmt.Sprintf("{%s}_%s", identifier, OTP_LOCK_HISTORY)
+}
+
+func GetVoiceTokenKey(identifier string) string {
+	return fmt.Sprintf("{%s}_%s", identifier, OTP_VOICE_TOKEN)
+}
+
+func GetDeliveryKey(identifier string) string {
+	return fmt.Sprintf("{%s}_%s", identifier, OTP_DELIVERY)
 }
 
-func GetOTPCodeKey(phoneNumber string) string {
-	return fmt.Sprintf("%s_%s", phoneNumber, OTP_CODE)
+// GetDeliveryStatusKey holds the message status transitions of one verification
+func GetDeliveryStatusKey(identifier string, verificationID string) string {
+	return fmt.Sprintf("{%s}_%s_%s", identifier, OTP_DELIVERY_STATUS, verificationID)
 }
 
-func GetOTPLockKey(phoneNumber string) string {
-	return fmt.Sprintf("%s_%s", phoneNumber, OTP_LOCK)
+// GetFallbackKey guards the fallback after one delivery attempt so it runs once across instances
+func GetFallbackKey(identifier string, verificationID string, attempt int) string {
+	return fmt.Sprintf("{%s}_%s_%s_%d", identifier, OTP_FALLBACK, verificationID, attempt)
+}
+
+// GetResendKey guards the resend cooldown of one verification so concurrent resends send once
+func GetResendKey(identifier string, verificationID string) string {
+	return fmt.Sprintf("{%s}_%s_%s", identifier, OTP_RESEND, verificationID)
+}
+
+// GetLimitKey holds the rolling window of one limit, e.g. sends
+func GetLimitKey(identifier string, limit string) string {
+	return fmt.Sprintf("{%s}_%s_%s", identifier, OTP_LIMIT, limit)
+}
+
+// GetLimitLockKey is set while the identifier is locked out by one limit
+func GetLimitLockKey(identifier string, limit string) string {
+	return fmt.Sprintf("{%s}_%s_%s_%s", identifier, OTP_LIMIT, limit, OTP_LOCK)
+}
+
+// GetApprovedKey is set once the code of one verification was verified
+func GetApprovedKey(identifier string, verificationID string) string {
+	return fmt.Sprintf("{%s}_%s_%s", identifier, OTP_APPROVED, verificationID)
+}
+
+// GetLastSentKey holds when a code last reached the provider, replays of older dead letters are skipped
+func GetLastSentKey(identifier string) string {
+	return fmt.Sprintf("{%s}_%s", identifier, OTP_LAST_SENT)
+}
+
+// GetVerificationKey holds a v2 verification resource, looked up by its ID alone
+func GetVerificationKey(verificationID string) string {
+	return fmt.Sprintf("%s_%s", OTP_VERIFICATION, verificationID)
+}
+
+// GetStatusCallbackKey holds the identifier and verification a status callback ref stands for
+func GetStatusCallbackKey(ref string) string {
+	return fmt.Sprintf("%s_%s", OTP_STATUS_CALLBACK, ref)
+}
+
+// getOptionalFromConf returns the conf value for key, found is false when the key is not in conf
+func getOptionalFromConf(key string) (string, bool, error) {
+	conf, err := loader.LoadConfig()
+	if err != nil {
+		Log.Debug("Error : Failed to load conf")
+		return "", false, err
+	}
+	if _, found := conf[key]; !found {
+		return "", false, nil
+	}
+	value, err := loader.GetValueFromConf(key)
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// GetStringFromConf loads key from conf, returning fallback when it is not set
+func GetStringFromConf(key string, fallback string) (string, error) {
+	value, found, err := getOptionalFromConf(key)
+	if err != nil {
+		Log.Debug(fmt.Sprintf("Error : Failed to load %s from conf", key))
+		return fallback, err
+	}
+	if !found {
+		return fallback, nil
+	}
+	return value, nil
+}
+
+// GetIntFromConf loads an integer from conf, returning fallback when it is not set
+func GetIntFromConf(key string, fallback int) (int, error) {
+	value, found, err := getOptionalFromConf(key)
+	if err != nil {
+		Log.Debug(fmt.Sprintf("Error : Failed to load %s from conf", key))
+		return fallback, err
+	}
+	if !found {
+		return fallback, nil
+	}
+	valueInt, err := strconv.Atoi(value)
+	if err != nil {
+		Log.Debug(fmt.Sprintf("Error : %s in conf is not an integer", key))
+		return fallback, err
+	}
+	return valueInt, nil
+}
+
+// GetBoolFromConf loads a "true"/"false" value from conf, returning fallback when it is not set
+func GetBoolFromConf(key string, fallback bool) (bool, error) {
+	value, found, err := getOptionalFromConf(key)
+	if err != nil {
+		Log.Debug(fmt.Sprintf("Error : Failed to load %s from conf", key))
+		return fallback, err
+	}
+	if !found {
+		return fallback, nil
+	}
+	valueBool, err := strconv.ParseBool(value)
+	if err != nil {
+		Log.Debug(fmt.Sprintf("Error : %s in conf is not a bool", key))
+		return fallback, err
+	}
+	return valueBool, nil
+}
+
+// GetSecondsFromConf loads a number of seconds from conf, returning fallback when it is not set
+func GetSecondsFromConf(key string, fallback time.Duration) (time.Duration, error) {
+	seconds, err := GetIntFromConf(key, -1)
+	if err != nil {
+		return fallback, err
+	}
+	if seconds < 0 {
+		return fallback, nil
+	}
+	return time.Second * time.Duration(seconds), nil
+}
+
+// CheckConf loads conf and parses the values every request depends on
+func CheckConf() error {
+	if _, err := loader.LoadConfig(); err != nil {
+		return err
+	}
+	if _, err := GetOTPTimeout(); err != nil {
+		return err
+	}
+	if _, err := GetLockTimeout(); err != nil {
+		return err
+	}
+	if _, err := GetOTPMaxTrials(); err != nil {
+		return err
+	}
+	return nil
 }